@@ -0,0 +1,326 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package blkiostat collects block I/O bytes per cgroup and device
+// from the blkio (cgroup v1) or io (cgroup v2) controller, e.g. to
+// attribute disk throughput to containers
+package blkiostat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/misc"
+)
+
+// CgroupStat tracks cgroups below Mountpoint. Cgroups is updated
+// by Collect(); use the accessor methods rather than reading it
+// directly from another goroutine
+type CgroupStat struct {
+	Cgroups    map[string]*PerCgroupStat
+	mu         sync.RWMutex
+	m          *metrics.MetricContext
+	Mountpoint string
+	// true if Mountpoint is a cgroup v2 hierarchy, io.stat is
+	// read instead of blkio.throttle.io_service_bytes
+	V2   bool
+	opts misc.Options
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+func NewCgroupStat(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CgroupStat {
+	return NewCgroupStatWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewCgroupStatWithContext returns an instance of CgroupStat
+// which stops collecting metrics once ctx is done. The blkio
+// subsystem is used if mounted, otherwise the cgroup v2 hierarchy.
+// If neither is mounted nothing is collected and LastError()
+// matches misc.ErrCgroupNotMounted with errors.Is
+func NewCgroupStatWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CgroupStat {
+	c := new(CgroupStat)
+	c.m = m
+	c.opts = misc.NewOptions(opts...)
+	c.Cgroups = make(map[string]*PerCgroupStat, 1)
+
+	mountpoint, err := misc.FindCgroupMount("blkio")
+	if errors.Is(err, misc.ErrCgroupNotMounted) {
+		mountpoint, err = misc.FindCgroup2Mount()
+		c.V2 = true
+	}
+	if err != nil {
+		c.RecordCollect(err)
+		return c
+	}
+	c.Mountpoint = mountpoint
+
+	ticker := c.StartTicker(Step, c.opts.Jitter)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Collect(mountpoint)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *CgroupStat) Collect(mountpoint string) {
+
+	// v2 cgroups have no tasks file
+	cgroups, err := misc.FindCgroupsOpts(mountpoint,
+		misc.FindCgroupsOptions{UseProcs: c.V2})
+	if err != nil {
+		c.RecordCollect(err)
+		return
+	}
+
+	if c.opts.CgroupFilter != nil {
+		filtered := cgroups[:0]
+		for _, cgroup := range cgroups {
+			if c.opts.CgroupFilter(cgroup) {
+				filtered = append(filtered, cgroup)
+			}
+		}
+		cgroups = filtered
+	}
+
+	// stop tracking cgroups which don't exist
+	// anymore or have no tasks
+	cgroupsMap := make(map[string]bool, len(cgroups))
+	for _, cgroup := range cgroups {
+		cgroupsMap[cgroup] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cgroup, s := range c.Cgroups {
+		if !cgroupsMap[cgroup] {
+			s.unregister()
+			delete(c.Cgroups, cgroup)
+		}
+	}
+
+	for _, cgroup := range cgroups {
+		s, ok := c.Cgroups[cgroup]
+		if !ok {
+			s = NewPerCgroupStat(c.m, cgroup, mountpoint, c.V2)
+			c.Cgroups[cgroup] = s
+		}
+		s.Collect()
+	}
+	c.RecordCollect(nil)
+}
+
+type ByReadWriteRate []*PerCgroupStat
+
+func (a ByReadWriteRate) Len() int      { return len(a) }
+func (a ByReadWriteRate) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByReadWriteRate) Less(i, j int) bool {
+	return a[i].ReadBytesRate()+a[i].WriteBytesRate() >
+		a[j].ReadBytesRate()+a[j].WriteBytesRate()
+}
+
+// ByReadWriteRate returns a slice of *PerCgroupStat entries sorted
+// by bytes read plus written per second, cgroups without two
+// samples yet are left out
+func (c *CgroupStat) ByReadWriteRate() []*PerCgroupStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	v := make([]*PerCgroupStat, 0, len(c.Cgroups))
+	for _, o := range c.Cgroups {
+		if !math.IsNaN(o.ReadBytesRate() + o.WriteBytesRate()) {
+			v = append(v, o)
+		}
+	}
+	sort.Sort(ByReadWriteRate(v))
+	return v
+}
+
+// Per Cgroup functions
+type PerCgroupStat struct {
+	// by device name, e.g. "sda". Updated by Collect(), use
+	// the accessor methods from other goroutines
+	Devices map[string]*PerDeviceStat
+	mu      sync.RWMutex // guards Devices
+	m       *metrics.MetricContext
+	path    string
+	prefix  string
+	v2      bool
+}
+
+// PerDeviceStat holds bytes transferred by a cgroup to and
+// from a single block device
+type PerDeviceStat struct {
+	ReadBytes  *metrics.Counter
+	WriteBytes *metrics.Counter
+}
+
+func NewPerCgroupStat(m *metrics.MetricContext, path string, mp string, v2 bool) *PerCgroupStat {
+	c := new(PerCgroupStat)
+	c.m = m
+	c.path = path
+	c.v2 = v2
+	rel, _ := filepath.Rel(mp, path)
+	c.prefix = "blkiostat.cgroup." + rel
+	c.Devices = make(map[string]*PerDeviceStat, 1)
+	return c
+}
+
+// Path returns the full path of the cgroup
+func (s *PerCgroupStat) Path() string {
+	return s.path
+}
+
+// ReadBytesRate returns bytes read per second across all devices
+func (s *PerCgroupStat) ReadBytesRate() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ret float64
+	for _, d := range s.Devices {
+		ret += d.ReadBytesRate()
+	}
+	return ret
+}
+
+// WriteBytesRate returns bytes written per second across all devices
+func (s *PerCgroupStat) WriteBytesRate() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ret float64
+	for _, d := range s.Devices {
+		ret += d.WriteBytesRate()
+	}
+	return ret
+}
+
+// ReadBytesRate returns bytes read from the device per second
+func (s *PerDeviceStat) ReadBytesRate() float64 {
+	return s.ReadBytes.ComputeRate()
+}
+
+// WriteBytesRate returns bytes written to the device per second
+func (s *PerDeviceStat) WriteBytesRate() float64 {
+	return s.WriteBytes.ComputeRate()
+}
+
+// Collect reads the per device byte counters of the cgroup
+//
+// v1 blkio.throttle.io_service_bytes:
+//
+//	8:0 Read 1234
+//	8:0 Write 5678
+//	...
+//	Total 6912
+//
+// v2 io.stat:
+//
+//	8:0 rbytes=1234 wbytes=5678 rios=10 wios=20 dbytes=0 dios=0
+func (s *PerCgroupStat) Collect() {
+	name := "blkio.throttle.io_service_bytes"
+	if s.v2 {
+		name = "io.stat"
+	}
+	file, err := os.Open(s.path + "/" + name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 2 || !strings.Contains(f[0], ":") {
+			continue
+		}
+		if s.v2 {
+			for _, kv := range f[1:] {
+				p := strings.SplitN(kv, "=", 2)
+				if len(p) != 2 {
+					continue
+				}
+				switch p[0] {
+				case "rbytes":
+					s.device(f[0]).ReadBytes.Set(misc.ParseUint(p[1]))
+				case "wbytes":
+					s.device(f[0]).WriteBytes.Set(misc.ParseUint(p[1]))
+				}
+			}
+			continue
+		}
+		if len(f) < 3 {
+			continue
+		}
+		switch f[1] {
+		case "Read":
+			s.device(f[0]).ReadBytes.Set(misc.ParseUint(f[2]))
+		case "Write":
+			s.device(f[0]).WriteBytes.Set(misc.ParseUint(f[2]))
+		}
+	}
+}
+
+// device returns the entry for major:minor devno, registering
+// its metrics the first time it is seen. Must be called with
+// s.mu held
+func (s *PerCgroupStat) device(devno string) *PerDeviceStat {
+	dev := deviceName(devno)
+	d, ok := s.Devices[dev]
+	if !ok {
+		d = new(PerDeviceStat)
+		misc.InitializeMetrics(d, s.m, s.prefix+"."+dev, true)
+		s.Devices[dev] = d
+	}
+	return d
+}
+
+func (s *PerCgroupStat) unregister() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dev, d := range s.Devices {
+		misc.UnregisterMetrics(d, s.m, s.prefix+"."+dev)
+	}
+}
+
+// deviceNames caches the names found by deviceName(), every
+// line of every cgroup would need a readlink otherwise
+var deviceNames = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// deviceName maps major:minor to the kernel device name using
+// /sys/dev/block, falling back to major_minor. Names found are
+// cached; a removed device's number usually comes back with the
+// same name
+func deviceName(devno string) string {
+	deviceNames.Lock()
+	defer deviceNames.Unlock()
+	if name, ok := deviceNames.m[devno]; ok {
+		return name
+	}
+	link, err := os.Readlink("/sys/dev/block/" + devno)
+	if err != nil {
+		return strings.Replace(devno, ":", "_", 1)
+	}
+	name := filepath.Base(link)
+	deviceNames.m[devno] = name
+	return name
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014 Square, Inc
+
+package blkiostat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/measure/metrics"
+)
+
+// TestConcurrentDevices is meant for go test -race: new devices
+// showing up while the rates are read must not break iteration
+func TestConcurrentDevices(t *testing.T) {
+	mp := t.TempDir()
+	path := filepath.Join(mp, "job")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := metrics.NewMetricContext("test")
+	s := NewPerCgroupStat(m, path, mp, true)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		stat := ""
+		for i := 0; i < 100; i++ {
+			// minor numbers no block device uses
+			stat += fmt.Sprintf("259:%d rbytes=%d wbytes=%d rios=1 wios=1\n",
+				4000+i, i*512, i*1024)
+			err := os.WriteFile(filepath.Join(path, "io.stat"), []byte(stat), 0644)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s.Collect()
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.ReadBytesRate()
+			s.WriteBytesRate()
+		}
+	}()
+	wg.Wait()
+
+	if n := len(s.Devices); n != 100 {
+		t.Errorf("%d devices tracked, want 100", n)
+	}
+	if _, ok := m.Counters["blkiostat.cgroup.job.259_4000.ReadBytes"]; !ok {
+		t.Errorf("per device metrics not registered as major_minor")
+	}
+}
@@ -4,10 +4,16 @@ package cpustat
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"math"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/measure/metrics"
@@ -22,28 +28,65 @@ import "C"
 
 var LINUX_TICKS_IN_SEC int = int(C.sysconf(C._SC_CLK_TCK))
 
+// CgroupStat tracks cgroups below Mountpoint. Cgroups is updated
+// by Collect(); use Snapshot() rather than reading it directly
+// from another goroutine
 type CgroupStat struct {
 	Cgroups    map[string]*PerCgroupStat
+	mu         sync.RWMutex
 	m          *metrics.MetricContext
 	Mountpoint string
+	// where cpuset subsystem is mounted, empty if not found
+	CpusetMountpoint string
+	// where cpuacct subsystem is mounted, empty if not found.
+	// When available per cgroup CPU times are read from
+	// cpuacct.stat instead of summing /proc/<pid>/stat of every
+	// process in the cgroup, unless misc.WithSumProcessTimes is
+	// passed
+	CpuacctMountpoint string
+	opts              misc.Options
+	misc.CollectStatus
+	misc.StepTicker
 }
 
-func NewCgroupStat(m *metrics.MetricContext, Step time.Duration) *CgroupStat {
+func NewCgroupStat(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CgroupStat {
+	return NewCgroupStatWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewCgroupStatWithContext returns an instance of CgroupStat
+// which stops collecting metrics once ctx is done
+// If the cpu subsystem isn't mounted nothing is collected and
+// LastError() matches misc.ErrCgroupNotMounted with errors.Is
+func NewCgroupStatWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CgroupStat {
 	c := new(CgroupStat)
 	c.m = m
+	c.opts = misc.NewOptions(opts...)
+	// see misc.Options.PruneGracePeriod
+	if c.opts.PruneGracePeriod == 0 {
+		c.opts.PruneGracePeriod = 3 * Step
+	}
 
 	c.Cgroups = make(map[string]*PerCgroupStat, 1)
 
 	mountpoint, err := misc.FindCgroupMount("cpu")
 	if err != nil {
+		c.RecordCollect(err)
 		return c
 	}
 	c.Mountpoint = mountpoint
+	c.CpusetMountpoint, _ = misc.FindCgroupMount("cpuset")
+	c.CpuacctMountpoint, _ = misc.FindCgroupMount("cpuacct")
 
-	ticker := time.NewTicker(Step)
+	ticker := c.StartTicker(Step, c.opts.Jitter)
 	go func() {
-		for _ = range ticker.C {
-			c.Collect(mountpoint)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Collect(mountpoint)
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -54,58 +97,170 @@ func (c *CgroupStat) Collect(mountpoint string) {
 
 	cgroups, err := misc.FindCgroups(mountpoint)
 	if err != nil {
+		c.RecordCollect(err)
 		return
 	}
 
-	// stop tracking cgroups which don't exist
-	// anymore or have no tasks
+	if c.opts.CgroupFilter != nil {
+		filtered := cgroups[:0]
+		for _, cgroup := range cgroups {
+			if c.opts.CgroupFilter(cgroup) {
+				filtered = append(filtered, cgroup)
+			}
+		}
+		cgroups = filtered
+	}
+
+	// stop tracking cgroups which don't exist anymore or
+	// have had no tasks for longer than the grace period
+	now := misc.Now()
 	cgroupsMap := make(map[string]bool, len(cgroups))
 	for _, cgroup := range cgroups {
 		cgroupsMap[cgroup] = true
 	}
 
-	for cgroup, _ := range c.Cgroups {
+	c.mu.Lock()
+	for cgroup, s := range c.Cgroups {
 		_, ok := cgroupsMap[cgroup]
-		if !ok {
+		if !ok && now.Sub(s.lastSeen) > c.opts.PruneGracePeriod {
+			prefix, _ := filepath.Rel(mountpoint, cgroup)
+			misc.UnregisterMetricsOpts(s, c.m, "cpustat.cgroup."+prefix, s.opts)
 			delete(c.Cgroups, cgroup)
 		}
 	}
 
+	onlineCPUs := misc.OnlineCPUs()
+	stats := make([]*PerCgroupStat, 0, len(cgroups))
 	for _, cgroup := range cgroups {
-		_, ok := c.Cgroups[cgroup]
+		s, ok := c.Cgroups[cgroup]
 		if !ok {
-			c.Cgroups[cgroup] = NewPerCgroupStat(c.m, cgroup, mountpoint)
+			s = newPerCgroupStat(c.m, cgroup, mountpoint, c.opts)
+			rel, _ := filepath.Rel(mountpoint, cgroup)
+			if c.CpusetMountpoint != "" {
+				s.cpusetPath = filepath.Join(c.CpusetMountpoint, rel)
+			}
+			if c.CpuacctMountpoint != "" && !c.opts.SumProcessTimes {
+				s.cpuacctPath = filepath.Join(c.CpuacctMountpoint, rel)
+			}
+			c.Cgroups[cgroup] = s
 		}
-		c.Cgroups[cgroup].Collect()
+		s.lastSeen = now
+		s.mu.Lock()
+		s.onlineCPUs = onlineCPUs
+		s.mu.Unlock()
+		stats = append(stats, s)
+	}
+	c.mu.Unlock()
+
+	// PerCgroupStat.Collect sleeps to sample process CPU
+	// times, don't hold the lock meanwhile
+	for _, s := range stats {
+		s.Collect()
+	}
+	c.RecordCollect(nil)
+}
+
+// CgroupSnapshot holds computed statistics for one cgroup
+type CgroupSnapshot struct {
+	Path         string         `json:"path"`
+	UsagePct     misc.JSONFloat `json:"usage_pct"`
+	UserspacePct misc.JSONFloat `json:"userspace_pct"`
+	KernelPct    misc.JSONFloat `json:"kernel_pct"`
+	ThrottlePct  misc.JSONFloat `json:"throttle_pct"`
+	Quota        misc.JSONFloat `json:"quota"` // null if unlimited
+	// usage as percentage of quota, null if unlimited
+	UsageVsQuotaPct misc.JSONFloat `json:"usage_vs_quota_pct"`
+}
+
+// ByThrottle sorts snapshots by ThrottlePct, most throttled
+// first; cgroups without a value yet go last
+type ByThrottle []CgroupSnapshot
+
+func (a ByThrottle) Len() int      { return len(a) }
+func (a ByThrottle) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByThrottle) Less(i, j int) bool {
+	x, y := float64(a[i].ThrottlePct), float64(a[j].ThrottlePct)
+	if math.IsNaN(y) {
+		return !math.IsNaN(x)
 	}
+	return x > y
+}
+
+// Snapshot returns current computed statistics for all tracked
+// cgroups sorted by path. Rates are computed once per cgroup, so
+// sorting the result (e.g. sort.Sort(ByThrottle(snap))) or
+// rendering it doesn't touch the live counters again and all
+// values come from the same instant. It is safe to call
+// concurrently with Collect
+func (c *CgroupStat) Snapshot() []CgroupSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	r := make([]CgroupSnapshot, 0, len(c.Cgroups))
+	for path, s := range c.Cgroups {
+		usage, quota := s.UsagePct.Get(), s.Quota()
+		r = append(r, CgroupSnapshot{
+			Path:            path,
+			UsagePct:        misc.JSONFloat(usage),
+			UserspacePct:    misc.JSONFloat(s.UserspacePct.Get()),
+			KernelPct:       misc.JSONFloat(s.KernelPct.Get()),
+			ThrottlePct:     misc.JSONFloat(s.Throttle()),
+			Quota:           misc.JSONFloat(quota),
+			UsageVsQuotaPct: misc.JSONFloat(usageVsQuota(usage, quota)),
+		})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Path < r[j].Path })
+	return r
 }
 
 // Per Cgroup functions
 type PerCgroupStat struct {
 	// raw metrics
-	Nr_periods     *metrics.Counter
-	Nr_throttled   *metrics.Counter
-	Throttled_time *metrics.Counter
-	Cfs_period_us  *metrics.Gauge
-	Cfs_quota_us   *metrics.Gauge
-	Utime          *metrics.Counter
-	Stime          *metrics.Counter
+	Nr_periods     *metrics.Counter `kind:"raw"`
+	Nr_throttled   *metrics.Counter `kind:"raw"`
+	Throttled_time *metrics.Counter `kind:"raw"`
+	Cfs_period_us  *metrics.Gauge   `kind:"raw"`
+	Cfs_quota_us   *metrics.Gauge   `kind:"raw"`
+	Utime          *metrics.Counter `kind:"raw"`
+	Stime          *metrics.Counter `kind:"raw"`
+	// cpuacct.usage in nanoseconds, only collected if the
+	// cpuacct subsystem is available
+	Cpuacct_usage *metrics.Counter `kind:"raw"`
 	// populate computed stats
 	UsagePct     *metrics.Gauge
 	UserspacePct *metrics.Gauge
 	KernelPct    *metrics.Gauge
 	//
-	m    *metrics.MetricContext
-	path string
+	m          *metrics.MetricContext
+	path       string
+	cpusetPath string
+	mu         sync.RWMutex // guards cpuSet, memSet, onlineCPUs and cpuacctPath
+	cpuSet     []int
+	memSet     []int
+	onlineCPUs int // misc.OnlineCPUs() as of the last CgroupStat.Collect()
+	// empty to sum per process CPU times
+	cpuacctPath string
+	lastSeen    time.Time // last time the cgroup had tasks
+	procs       struct {
+		mu    sync.Mutex
+		comms []string
+		read  time.Time
+	} // cache of Processes()
+	opts misc.Options
 }
 
 func NewPerCgroupStat(m *metrics.MetricContext, path string, mp string) *PerCgroupStat {
+	return newPerCgroupStat(m, path, mp, misc.Options{})
+}
+
+func newPerCgroupStat(m *metrics.MetricContext, path string, mp string, opts misc.Options) *PerCgroupStat {
 	c := new(PerCgroupStat)
 	c.m = m
 	c.path = path
+	c.opts = opts
 	// initialize all metrics and register them
 	prefix, _ := filepath.Rel(mp, path)
-	misc.InitializeMetrics(c, m, "cpustat.cgroup."+prefix, true)
+	misc.InitializeMetricsOpts(c, m, "cpustat.cgroup."+prefix, true, opts)
 	return c
 }
 
@@ -118,9 +273,93 @@ func (s *PerCgroupStat) Throttle() float64 {
 	return (throttled_sec / (1 * 1000 * 1000 * 1000)) * 100
 }
 
-// Quota returns how many logical CPUs can be used by this cgroup
+// ThrottledSeconds returns the cumulative time the cgroup
+// was throttled (throttled_time in cpu.stat) in seconds
+func (s *PerCgroupStat) ThrottledSeconds() float64 {
+	return float64(s.Throttled_time.Get()) / (1 * 1000 * 1000 * 1000)
+}
+
+// NrThrottled returns the cumulative number of periods the
+// cgroup was throttled in (nr_throttled in cpu.stat)
+func (s *PerCgroupStat) NrThrottled() uint64 {
+	return s.Nr_throttled.Get()
+}
+
+// Quota returns how many logical CPUs can be used by this cgroup,
+// NaN if its quota is unlimited (cpu.cfs_quota_us is -1)
 func (s *PerCgroupStat) Quota() float64 {
-	return (s.Cfs_quota_us.Get() / s.Cfs_period_us.Get())
+	quota := s.Cfs_quota_us.Get()
+	if quota < 0 {
+		return math.NaN()
+	}
+	return (quota / s.Cfs_period_us.Get())
+}
+
+// UsageVsQuota returns Usage() as percentage of Quota(), i.e. how
+// much of its allotted CPU the cgroup consumes; 100 means it uses
+// all of it. NaN if the quota is unlimited
+func (s *PerCgroupStat) UsageVsQuota() float64 {
+	return usageVsQuota(s.Usage(), s.Quota())
+}
+
+// usageVsQuota returns usage percent as percentage of quota CPUs,
+// NaN if quota is NaN (unlimited)
+func usageVsQuota(usage, quota float64) float64 {
+	return (usage / (quota * 100)) * 100
+}
+
+// processesTTL is how long Processes() reuses its last result
+const processesTTL = 5 * time.Second
+
+// Processes returns the sorted comms (/proc/<pid>/comm) of the
+// processes in the cgroup, one entry per process. The result is
+// cached for a few seconds. Processes exiting before their comm is
+// read are left out
+func (s *PerCgroupStat) Processes() []string {
+	s.procs.mu.Lock()
+	defer s.procs.mu.Unlock()
+	if s.procs.comms != nil && misc.Since(s.procs.read) < processesTTL {
+		return s.procs.comms
+	}
+
+	comms := make([]string, 0)
+	procsFd, err := os.Open(s.path + "/" + "cgroup.procs")
+	if err != nil {
+		return comms
+	}
+	defer procsFd.Close()
+
+	scanner := bufio.NewScanner(procsFd)
+	for scanner.Scan() {
+		comm, err := misc.ReadStringFromFile("/proc/" + scanner.Text() + "/comm")
+		if err != nil {
+			continue
+		}
+		comms = append(comms, comm)
+	}
+	sort.Strings(comms)
+	s.procs.comms = comms
+	s.procs.read = misc.Now()
+	return comms
+}
+
+// SetQuota limits the cgroup to cpus logical CPUs by writing
+// cpu.cfs_quota_us = cpus * cpu.cfs_period_us. This modifies the
+// cgroup and requires write access to it
+func (s *PerCgroupStat) SetQuota(cpus float64) error {
+	if !(cpus > 0) || math.IsInf(cpus, 1) {
+		return errors.New("quota must be a positive, finite number of CPUs")
+	}
+	period, err := misc.ReadUintFromFileErr(s.path + "/" + "cpu.cfs_period_us")
+	if err != nil {
+		return err
+	}
+	// cpu.cfs_quota_us is a signed 64 bit number of microseconds
+	quota := cpus * float64(period)
+	if !(quota < math.MaxInt64) {
+		return errors.New("quota is out of range of cpu.cfs_quota_us")
+	}
+	return misc.WriteUintToFile(s.path+"/"+"cpu.cfs_quota_us", uint64(quota))
 }
 
 // Usage returns cumulative CPU used by processes in this
@@ -130,6 +369,52 @@ func (s *PerCgroupStat) Usage() float64 {
 	return (rate_per_sec * 100) / float64(LINUX_TICKS_IN_SEC)
 }
 
+// UsageNormalized returns Usage() divided by AllowedCPUs()
+// so that it ranges 0-100, 100 meaning every allowed CPU is fully
+// used by the cgroup. This is relative to the CPUs the cgroup can run on,
+// not to its CFS bandwidth limit; a cgroup with Quota() of 2 on an
+// 8 CPU host can't exceed 25
+func (s *PerCgroupStat) UsageNormalized() float64 {
+	return s.Usage() / float64(s.AllowedCPUs())
+}
+
+// AllowedCPUs returns the number of CPUs the cgroup may run on
+// according to cpuset.cpus, or the number of online CPUs as of
+// the last Collect() (runtime.NumCPU() where that is unknown) if
+// the cpuset isn't known
+func (s *PerCgroupStat) AllowedCPUs() int {
+	s.mu.RLock()
+	n, online := len(s.cpuSet), s.onlineCPUs
+	s.mu.RUnlock()
+	if n > 0 {
+		return n
+	}
+	if online > 0 {
+		return online
+	}
+	if n := misc.OnlineCPUs(); n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// CPUSet returns cpuset.cpus of the matching cpuset cgroup, nil
+// if unavailable. The slice is replaced, not modified, by
+// Collect() and must not be modified by the caller either
+func (s *PerCgroupStat) CPUSet() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cpuSet
+}
+
+// MemSet returns cpuset.mems of the matching cpuset cgroup, nil
+// if unavailable. Same rules as CPUSet()
+func (s *PerCgroupStat) MemSet() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.memSet
+}
+
 // Userspace returns cumulative CPU spent by processes in this
 // cgroup in userspace as percentage
 func (s *PerCgroupStat) Userspace() float64 {
@@ -147,26 +432,17 @@ func (s *PerCgroupStat) Kernel() float64 {
 // Collect reads cpu.stat for cgroups and per process cpu.stat
 // entries for all processes in the cgroup
 func (s *PerCgroupStat) Collect() {
-	file, err := os.Open(s.path + "/" + "cpu.stat")
-	defer file.Close()
+	stat, err := misc.ReadKVUint(s.path+"/"+"cpu.stat", "")
 	if err != nil {
 		return
 	}
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		f := regexp.MustCompile("\\s+").Split(scanner.Text(), 2)
-
-		if f[0] == "nr_periods" {
-			s.Nr_periods.Set(misc.ParseUint(f[1]))
-		}
-
-		if f[0] == "nr_throttled" {
-			s.Nr_throttled.Set(misc.ParseUint(f[1]))
-		}
-
-		if f[0] == "throttled_time" {
-			s.Throttled_time.Set(misc.ParseUint(f[1]))
+	for k, c := range map[string]*metrics.Counter{
+		"nr_periods":     s.Nr_periods,
+		"nr_throttled":   s.Nr_throttled,
+		"throttled_time": s.Throttled_time,
+	} {
+		if v, ok := stat[k]; ok {
+			c.Set(v)
 		}
 	}
 
@@ -174,19 +450,65 @@ func (s *PerCgroupStat) Collect() {
 		float64(misc.ReadUintFromFile(
 			s.path + "/" + "cpu.cfs_period_us")))
 
-	s.Cfs_quota_us.Set(
-		float64(misc.ReadUintFromFile(
-			s.path + "/" + "cpu.cfs_quota_us")))
+	// -1 if unlimited
+	quota := math.NaN()
+	if line, err := misc.ReadStringFromFile(s.path + "/" + "cpu.cfs_quota_us"); err == nil {
+		if v, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64); err == nil {
+			quota = float64(v)
+		}
+	}
+	s.Cfs_quota_us.Set(quota)
+
+	if s.cpusetPath != "" {
+		cpus := readCPUList(s.cpusetPath + "/" + "cpuset.cpus")
+		mems := readCPUList(s.cpusetPath + "/" + "cpuset.mems")
+		s.mu.Lock()
+		s.cpuSet, s.memSet = cpus, mems
+		s.mu.Unlock()
+	}
+
+	// Use the kernel's accounting if available. Utime and
+	// Stime are then cumulative and rates are computed
+	// across Collect() calls
+	s.mu.RLock()
+	cpuacctPath := s.cpuacctPath
+	s.mu.RUnlock()
+	if cpuacctPath != "" {
+		if s.collectCpuacct(cpuacctPath) {
+			s.UsagePct.Set(s.Usage())
+			s.UserspacePct.Set(s.Userspace())
+			s.KernelPct.Set(s.Kernel())
+			return
+		}
+		// don't mix cumulative and per sample counter
+		// values, fall back for good
+		s.mu.Lock()
+		s.cpuacctPath = ""
+		s.mu.Unlock()
+		s.Utime.Reset()
+		s.Stime.Reset()
+	}
 
 	// Calculate approximate cumulative CPU usage for all
-	// processes within this cgroup by calculating difference
-	// between sum number of ticks.
+	// processes within this cgroup by summing the difference
+	// in ticks of each process over one second.
 	// We reset between loops because PIDs within cgroup can
 	// change and sum-counter from previous value can be
 	// unreliable
-	s.getCgroupCPUTimes()
+	before := s.getCgroupCPUTimes()
+	s.Utime.Set(0)
+	s.Stime.Set(0)
 	time.Sleep(time.Millisecond * 1000)
-	s.getCgroupCPUTimes()
+	after := s.getCgroupCPUTimes()
+
+	utime, stime, vanished := diffCPUTimes(before, after)
+	if vanished*2 > len(before) {
+		// most processes exited meanwhile, the sum isn't
+		// meaningful; keep the previous summary metrics
+		return
+	}
+	s.Utime.Set(utime)
+	s.Stime.Set(stime)
 	// Expose summary metrics for easy json access
 	s.UsagePct.Set(s.Usage())
 	s.UserspacePct.Set(s.Userspace())
@@ -197,39 +519,125 @@ func (s *PerCgroupStat) Collect() {
 }
 
 // unexported
-func (s *PerCgroupStat) getCgroupCPUTimes() {
-	// Compute user/system cpu times for all processes in this
-	// cgroup
-	var utime, stime uint64
+
+// collectCpuacct reads user and system time (in USER_HZ, same as
+// /proc/<pid>/stat) from cpuacct.stat and total usage from
+// cpuacct.usage below path. Returns false if cpuacct.stat can't
+// be read
+func (s *PerCgroupStat) collectCpuacct(path string) bool {
+	file, err := os.Open(path + "/" + "cpuacct.stat")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	var user, system bool
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 2 {
+			continue
+		}
+		switch f[0] {
+		case "user":
+			s.Utime.Set(misc.ParseUint(f[1]))
+			user = true
+		case "system":
+			s.Stime.Set(misc.ParseUint(f[1]))
+			system = true
+		}
+	}
+	if !user || !system {
+		return false
+	}
+
+	usage, err := misc.ReadUintFromFileErr(path + "/" + "cpuacct.usage")
+	if err == nil {
+		s.Cpuacct_usage.Set(usage)
+	}
+	return true
+}
+
+// cpuTimes holds user and system ticks of a process
+type cpuTimes struct {
+	user   uint64
+	system uint64
+}
+
+// getCgroupCPUTimes returns user/system cpu times of all
+// processes in this cgroup by pid. Processes which exit
+// before their stat is read are left out
+func (s *PerCgroupStat) getCgroupCPUTimes() map[string]cpuTimes {
+	ret := make(map[string]cpuTimes)
 	procsFd, err := os.Open(s.path + "/" + "cgroup.procs")
-	defer procsFd.Close()
 	if err != nil {
-		return
+		return ret
 	}
+	defer procsFd.Close()
 
 	scanner := bufio.NewScanner(procsFd)
 	for scanner.Scan() {
-		u, s := getCPUTimes(scanner.Text())
-		utime += u
-		stime += s
+		pid := scanner.Text()
+		u, s, ok := getCPUTimes(pid)
+		if ok {
+			ret[pid] = cpuTimes{u, s}
+		}
 	}
-	s.Utime.Set(utime)
-	s.Stime.Set(stime)
+	return ret
+}
+
+// diffCPUTimes sums the ticks each process used between two
+// samples. Only processes present in both count: a process
+// exiting in between would otherwise make the sum drop (a
+// negative rate) and one starting would add its whole lifetime.
+// Returns the number of processes of before missing from after
+func diffCPUTimes(before, after map[string]cpuTimes) (utime, stime uint64, vanished int) {
+	for pid, b := range before {
+		a, ok := after[pid]
+		// pid reuse could make times go backwards
+		if !ok || a.user < b.user || a.system < b.system {
+			vanished++
+			continue
+		}
+		utime += a.user - b.user
+		stime += a.system - b.system
+	}
+	return utime, stime, vanished
+}
+
+// readCPUList reads a list like "0-3,8" from path and
+// returns it expanded or nil on error
+func readCPUList(path string) []int {
+	line, err := misc.ReadStringFromFile(path)
+	if err != nil {
+		return nil
+	}
+	cpus, err := misc.ParseRangeList(line)
+	if err != nil {
+		return nil
+	}
+	return cpus
 }
 
-func getCPUTimes(pid string) (uint64, uint64) {
+// getCPUTimes returns user and system ticks of pid from
+// /proc/<pid>/stat, ok is false if the process is gone
+func getCPUTimes(pid string) (user, system uint64, ok bool) {
 	file, err := os.Open("/proc/" + pid + "/stat")
-	defer file.Close()
 	if err != nil {
-		return 0, 0
+		return 0, 0, false
 	}
+	defer file.Close()
 
-	var user, system uint64
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		f := strings.Split(scanner.Text(), " ")
-		user = misc.ParseUint(f[13])
-		system = misc.ParseUint(f[14])
+		// comm (field 2) may contain spaces, count
+		// fields from its closing parenthesis
+		line := scanner.Text()
+		f := strings.Fields(line[strings.LastIndexByte(line, ')')+1:])
+		if len(f) < 13 {
+			return 0, 0, false
+		}
+		return misc.ParseUint(f[11]), misc.ParseUint(f[12]), true
 	}
-	return user, system
+	return 0, 0, false
 }
@@ -0,0 +1,430 @@
+// Copyright (c) 2014 Square, Inc
+
+package cpustat
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/misc"
+)
+
+// newTestCgroupStat returns a CgroupStat which only collects when
+// Collect() is called and doesn't use the host's cpuset and
+// cpuacct hierarchies
+func newTestCgroupStat(t *testing.T, opts ...misc.Option) (*CgroupStat, *metrics.MetricContext) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m := metrics.NewMetricContext("test")
+	c := NewCgroupStatWithContext(ctx, m, time.Hour, opts...)
+	c.CpusetMountpoint = ""
+	c.CpuacctMountpoint = ""
+	return c, m
+}
+
+func writeTasks(t *testing.T, cgroup, tasks string) {
+	if err := os.WriteFile(filepath.Join(cgroup, "tasks"), []byte(tasks), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectPruneGracePeriod(t *testing.T) {
+	fake := misc.NewFakeClock(time.Unix(1700000000, 0))
+	defer misc.SetClock(fake)()
+
+	mp := t.TempDir()
+	cgroup := filepath.Join(mp, "a")
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTasks(t, cgroup, "1\n")
+
+	c, m := newTestCgroupStat(t, misc.WithPruneGracePeriod(10*time.Second))
+	c.Collect(mp)
+	s, ok := c.Cgroups[cgroup]
+	if !ok {
+		t.Fatalf("%s not tracked", cgroup)
+	}
+
+	// tasks migrate away and back within the grace period
+	writeTasks(t, cgroup, "")
+	fake.Advance(5 * time.Second)
+	c.Collect(mp)
+	if c.Cgroups[cgroup] != s {
+		t.Fatalf("%s pruned within the grace period", cgroup)
+	}
+	writeTasks(t, cgroup, "2\n")
+	fake.Advance(5 * time.Second)
+	c.Collect(mp)
+	if c.Cgroups[cgroup] != s {
+		t.Fatalf("%s replaced after refilling", cgroup)
+	}
+	if _, ok := m.Counters["cpustat.cgroup.a.Nr_periods"]; !ok {
+		t.Errorf("cpustat.cgroup.a.Nr_periods not registered")
+	}
+
+	// empty for longer than the grace period
+	writeTasks(t, cgroup, "")
+	fake.Advance(5 * time.Second)
+	c.Collect(mp)
+	if c.Cgroups[cgroup] != s {
+		t.Fatalf("%s pruned within the grace period", cgroup)
+	}
+	fake.Advance(6 * time.Second)
+	c.Collect(mp)
+	if _, ok := c.Cgroups[cgroup]; ok {
+		t.Errorf("%s still tracked after the grace period", cgroup)
+	}
+	if _, ok := m.Counters["cpustat.cgroup.a.Nr_periods"]; ok {
+		t.Errorf("cpustat.cgroup.a.Nr_periods still registered after pruning")
+	}
+}
+
+func TestCollectPruneImmediately(t *testing.T) {
+	mp := t.TempDir()
+	cgroup := filepath.Join(mp, "a")
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTasks(t, cgroup, "1\n")
+
+	c, _ := newTestCgroupStat(t, misc.WithPruneGracePeriod(-1))
+	c.Collect(mp)
+	if _, ok := c.Cgroups[cgroup]; !ok {
+		t.Fatalf("%s not tracked", cgroup)
+	}
+	writeTasks(t, cgroup, "")
+	c.Collect(mp)
+	if _, ok := c.Cgroups[cgroup]; ok {
+		t.Errorf("%s still tracked once empty with a negative grace period", cgroup)
+	}
+}
+
+func TestCollectSumProcessTimes(t *testing.T) {
+	mp := t.TempDir()
+	cgroup := filepath.Join(mp, "a")
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTasks(t, cgroup, "1\n")
+
+	for _, sum := range []bool{false, true} {
+		var opts []misc.Option
+		if sum {
+			opts = append(opts, misc.WithSumProcessTimes())
+		}
+		c, _ := newTestCgroupStat(t, opts...)
+		c.CpuacctMountpoint = mp
+		c.Collect(mp)
+		s, ok := c.Cgroups[cgroup]
+		if !ok {
+			t.Fatalf("%s not tracked", cgroup)
+		}
+		if got := s.cpuacctPath == ""; got != sum {
+			t.Errorf("SumProcessTimes %v: cpuacctPath = %q", sum, s.cpuacctPath)
+		}
+	}
+}
+
+// benchCgroupProcesses is the size of the cgroup compared by the
+// BenchmarkCgroupCPUTimes benchmarks
+const benchCgroupProcesses = 1000
+
+func BenchmarkCgroupCPUTimesCpuacct(b *testing.B) {
+	dir := b.TempDir()
+	for name, data := range map[string]string{
+		"cpuacct.stat":  "user 123456\nsystem 65432\n",
+		"cpuacct.usage": "1888880000000\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	s := newPerCgroupStat(metrics.NewMetricContext("bench"), dir, filepath.Dir(dir), misc.Options{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !s.collectCpuacct(dir) {
+			b.Fatal("collectCpuacct failed")
+		}
+	}
+}
+
+// BenchmarkCgroupCPUTimesSum reads one /proc/<pid>/stat per process
+// like Collect() does twice per sample without cpuacct. The
+// benchmark's own pid stands in for every process of the cgroup,
+// the cost being an open and read per entry of cgroup.procs
+func BenchmarkCgroupCPUTimesSum(b *testing.B) {
+	dir := b.TempDir()
+	pid := strconv.Itoa(os.Getpid()) + "\n"
+	procs := strings.Repeat(pid, benchCgroupProcesses)
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(procs), 0644); err != nil {
+		b.Fatal(err)
+	}
+	s := newPerCgroupStat(metrics.NewMetricContext("bench"), dir, filepath.Dir(dir), misc.Options{})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(s.getCgroupCPUTimes()) == 0 {
+			b.Fatal("no process times read")
+		}
+	}
+}
+
+func TestDiffCPUTimes(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after map[string]cpuTimes
+		utime, stime  uint64
+		vanished      int
+	}{
+		{
+			name:   "same processes",
+			before: map[string]cpuTimes{"1": {10, 5}, "2": {20, 10}},
+			after:  map[string]cpuTimes{"1": {15, 6}, "2": {30, 12}},
+			utime:  15,
+			stime:  3,
+		},
+		{
+			name:     "one process exited",
+			before:   map[string]cpuTimes{"1": {10, 5}, "2": {20, 10}},
+			after:    map[string]cpuTimes{"1": {15, 6}},
+			utime:    5,
+			stime:    1,
+			vanished: 1,
+		},
+		{
+			// its whole lifetime would otherwise be added
+			name:   "process started",
+			before: map[string]cpuTimes{"1": {10, 5}},
+			after:  map[string]cpuTimes{"1": {15, 6}, "3": {500, 300}},
+			utime:  5,
+			stime:  1,
+		},
+		{
+			// the pid was reused by a younger process
+			name:     "pid reused",
+			before:   map[string]cpuTimes{"1": {10, 5}, "2": {200, 100}},
+			after:    map[string]cpuTimes{"1": {15, 6}, "2": {3, 1}},
+			utime:    5,
+			stime:    1,
+			vanished: 1,
+		},
+		{
+			name:     "every process exited",
+			before:   map[string]cpuTimes{"1": {10, 5}, "2": {20, 10}},
+			after:    map[string]cpuTimes{},
+			vanished: 2,
+		},
+		{
+			name:  "empty cgroup",
+			after: map[string]cpuTimes{"1": {15, 6}},
+		},
+	}
+	for _, tt := range tests {
+		utime, stime, vanished := diffCPUTimes(tt.before, tt.after)
+		if utime != tt.utime || stime != tt.stime || vanished != tt.vanished {
+			t.Errorf("%s: diffCPUTimes() = %d, %d, %d, want %d, %d, %d", tt.name,
+				utime, stime, vanished, tt.utime, tt.stime, tt.vanished)
+		}
+	}
+}
+
+func TestUsageVsQuota(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		usage, quota, want float64
+	}{
+		// exactly at quota
+		{200, 2, 100},
+		{50, 0.5, 100},
+		{100, 2, 50},
+		// bursting above quota within a period
+		{300, 2, 150},
+		{0, 2, 0},
+		// unlimited
+		{150, nan, nan},
+		// not collected yet
+		{nan, 2, nan},
+	}
+	for _, tt := range tests {
+		got := usageVsQuota(tt.usage, tt.quota)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("usageVsQuota(%v, %v) = %v, want %v", tt.usage, tt.quota, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedCPUs(t *testing.T) {
+	mp := t.TempDir()
+	cgroup := filepath.Join(mp, "a")
+	if err := os.Mkdir(cgroup, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTasks(t, cgroup, "1\n")
+
+	c, _ := newTestCgroupStat(t)
+	c.Collect(mp)
+	s, ok := c.Cgroups[cgroup]
+	if !ok {
+		t.Fatalf("%s not tracked", cgroup)
+	}
+	want := misc.OnlineCPUs()
+	if want == 0 {
+		want = runtime.NumCPU()
+	}
+	if got := s.AllowedCPUs(); got != want {
+		t.Errorf("AllowedCPUs() without a cpuset = %d, want %d", got, want)
+	}
+
+	// the count cached by Collect() is used until the next one
+	s.mu.Lock()
+	s.onlineCPUs = want + 1
+	s.mu.Unlock()
+	if got := s.AllowedCPUs(); got != want+1 {
+		t.Errorf("AllowedCPUs() = %d, want cached %d", got, want+1)
+	}
+
+	s.mu.Lock()
+	s.cpuSet = []int{0, 2}
+	s.mu.Unlock()
+	if got := s.AllowedCPUs(); got != 2 {
+		t.Errorf("AllowedCPUs() with cpuset 0,2 = %d, want 2", got)
+	}
+}
+
+func TestSetQuota(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"cpu.cfs_period_us": "100000\n",
+		"cpu.cfs_quota_us":  "-1\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newPerCgroupStat(metrics.NewMetricContext("test"), dir, filepath.Dir(dir), misc.Options{})
+
+	for _, cpus := range []float64{0, -1, math.NaN(), math.Inf(1), math.Inf(-1), 1e300} {
+		if err := s.SetQuota(cpus); err == nil {
+			t.Errorf("SetQuota(%v) = nil, want an error", cpus)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us")); string(data) != "-1\n" {
+		t.Errorf("cpu.cfs_quota_us = %q after rejected quotas, want unchanged", data)
+	}
+
+	if err := s.SetQuota(1.5); err != nil {
+		t.Fatalf("SetQuota(1.5) = %v", err)
+	}
+	if v, err := misc.ReadUintFromFileErr(filepath.Join(dir, "cpu.cfs_quota_us")); err != nil || v != 150000 {
+		t.Errorf("cpu.cfs_quota_us = %d, %v after SetQuota(1.5), want 150000", v, err)
+	}
+}
+
+func TestUsageVsQuotaUnlimited(t *testing.T) {
+	// -1 is what cgroup v1 reports, "max" (the cgroup v2
+	// spelling) isn't a number and mustn't become a quota either
+	for _, quota := range []string{"-1", "max"} {
+		dir := t.TempDir()
+		for name, data := range map[string]string{
+			"cpu.stat":          "nr_periods 0\nnr_throttled 0\nthrottled_time 0\n",
+			"cpu.cfs_period_us": "100000\n",
+			"cpu.cfs_quota_us":  quota + "\n",
+			"cpuacct.stat":      "user 100\nsystem 50\n",
+		} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := newPerCgroupStat(metrics.NewMetricContext("test"), dir, filepath.Dir(dir), misc.Options{})
+		s.cpuacctPath = dir
+		s.Collect()
+		time.Sleep(10 * time.Millisecond)
+		if err := os.WriteFile(filepath.Join(dir, "cpuacct.stat"), []byte("user 200\nsystem 60\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s.Collect()
+
+		if v := s.Usage(); !(v > 0) {
+			t.Errorf("quota %s: Usage() = %v, want > 0", quota, v)
+		}
+		if v := s.Quota(); !math.IsNaN(v) {
+			t.Errorf("quota %s: Quota() = %v, want NaN", quota, v)
+		}
+		if v := s.UsageVsQuota(); !math.IsNaN(v) {
+			t.Errorf("quota %s: UsageVsQuota() = %v, want NaN", quota, v)
+		}
+	}
+}
+
+// newBenchCgroupStat returns a CgroupStat tracking n cgroups with
+// two samples of their counters each
+func newBenchCgroupStat(n int) *CgroupStat {
+	m := metrics.NewMetricContext("bench")
+	c := &CgroupStat{Cgroups: make(map[string]*PerCgroupStat, n), m: m}
+	for i := 0; i < n; i++ {
+		path := "/sys/fs/cgroup/cpu/cg" + strconv.Itoa(i)
+		s := newPerCgroupStat(m, path, "/sys/fs/cgroup/cpu", misc.Options{})
+		s.Cfs_period_us.Set(100000)
+		s.Cfs_quota_us.Set(200000)
+		s.Throttled_time.Set(0)
+		s.Utime.Set(0)
+		s.Stime.Set(0)
+		c.Cgroups[path] = s
+	}
+	time.Sleep(time.Millisecond)
+	i := uint64(0)
+	for _, s := range c.Cgroups {
+		i++
+		s.Throttled_time.Set(i * 1000)
+		s.Utime.Set(i)
+		s.Stime.Set(i / 2)
+		s.UsagePct.Set(s.Usage())
+		s.UserspacePct.Set(s.Userspace())
+		s.KernelPct.Set(s.Kernel())
+	}
+	return c
+}
+
+const benchCgroups = 500
+
+// BenchmarkCgroupSnapshotByThrottle sorts 500 cgroups by throttling
+// and reads their statistics through Snapshot()
+func BenchmarkCgroupSnapshotByThrottle(b *testing.B) {
+	c := newBenchCgroupStat(benchCgroups)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		snap := c.Snapshot()
+		sort.Sort(ByThrottle(snap))
+	}
+}
+
+// BenchmarkCgroupAccessorsByThrottle does the same through the
+// PerCgroupStat accessors, computing rates on every call
+func BenchmarkCgroupAccessorsByThrottle(b *testing.B) {
+	c := newBenchCgroupStat(benchCgroups)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		v := make([]*PerCgroupStat, 0, len(c.Cgroups))
+		for _, s := range c.Cgroups {
+			v = append(v, s)
+		}
+		sort.Slice(v, func(i, j int) bool { return v[i].Throttle() > v[j].Throttle() })
+		var sum float64
+		for _, s := range v {
+			sum += s.Usage() + s.Userspace() + s.Kernel() + s.Throttle() +
+				s.Quota() + s.UsageVsQuota()
+		}
+		_ = sum
+	}
+}
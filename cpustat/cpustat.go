@@ -0,0 +1,35 @@
+// Copyright (c) 2014 Square, Inc
+
+package cpustat
+
+import (
+	"context"
+)
+
+// number of successful Collect() calls before rates are available
+const warmupSamples = 2
+
+// WaitForWarmup blocks until the collection goroutine has completed
+// two successful Collect() calls, after which rate based methods
+// such as Usage() return real values instead of NaN. It returns
+// ctx.Err() if ctx is done first
+func (s *CPUStat) WaitForWarmup(ctx context.Context) error {
+	select {
+	case <-s.warm:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// signalWarmup is called by the collection goroutine after
+// every Collect()
+func (s *CPUStat) signalWarmup() {
+	if s.samples >= warmupSamples || s.LastError() != nil {
+		return
+	}
+	s.samples++
+	if s.samples == warmupSamples {
+		close(s.warm)
+	}
+}
@@ -1,8 +1,11 @@
 package cpustat
 
+import "context"
+import "fmt"
 import "unsafe"
 import "time"
 import "math"
+import "sync"
 import "github.com/measure/metrics"
 import "github.com/measure/os/misc"
 
@@ -14,12 +17,56 @@ import "github.com/measure/os/misc"
 #include <mach/mach_host.h>
 #include <mach/mach_port.h>
 #include <mach/host_info.h>
+#include <sys/types.h>
+#include <sys/sysctl.h>
+#include <sys/time.h>
+
+// returns kern.boottime in seconds since the epoch or -1
+long long get_boottime() {
+	int mib[2] = { CTL_KERN, KERN_BOOTTIME };
+	struct timeval tv;
+	size_t length = sizeof(tv);
+
+	if (sysctl(mib, 2, &tv, &length, NULL, 0) != 0)
+		return -1;
+	return tv.tv_sec;
+}
 */
 import "C"
 
 type CPUStat struct {
-	All *CPUStatPerCPU
-	m   *metrics.MetricContext
+	All     *CPUStatPerCPU
+	m       *metrics.MetricContext
+	warm    chan struct{} // closed once warmed up
+	samples int           // successful collections, up to warmupSamples
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+var bootTime struct {
+	once sync.Once
+	t    time.Time
+}
+
+// BootTime returns the time the system booted (kern.boottime)
+// or the zero time if it can't be read. Read once and cached
+func (s *CPUStat) BootTime() time.Time {
+	bootTime.once.Do(func() {
+		if sec := C.get_boottime(); sec > 0 {
+			bootTime.t = time.Unix(int64(sec), 0)
+		}
+	})
+	return bootTime.t
+}
+
+// Uptime returns time elapsed since BootTime(), 0 if it
+// isn't known
+func (s *CPUStat) Uptime() time.Duration {
+	bt := s.BootTime()
+	if bt.IsZero() {
+		return 0
+	}
+	return misc.Since(bt)
 }
 
 type CPUStatPerCPU struct {
@@ -30,14 +77,29 @@ type CPUStatPerCPU struct {
 	Total       *metrics.Counter // total ticks
 }
 
-func New(m *metrics.MetricContext, Step time.Duration) *CPUStat {
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CPUStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewWithContext returns an instance of CPUStat which stops
+// collecting metrics once ctx is done. Of the opts only
+// Jitter applies, no darwin metric is raw
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CPUStat {
 	c := new(CPUStat)
 	c.All = CPUStatPerCPUNew(m, "cpu")
 	c.m = m
-	ticker := time.NewTicker(Step)
+	c.warm = make(chan struct{})
+	ticker := c.StartTicker(Step, misc.NewOptions(opts...).Jitter)
 	go func() {
-		for _ = range ticker.C {
-			c.Collect()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Collect()
+				c.signalWarmup()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	return c
@@ -54,6 +116,7 @@ func (s *CPUStat) Collect() {
 		C.host_info_t(unsafe.Pointer(&cpuinfo)), &count)
 
 	if ret != C.KERN_SUCCESS {
+		s.RecordCollect(fmt.Errorf("host_statistics failed: %d", ret))
 		return
 	}
 
@@ -67,6 +130,7 @@ func (s *CPUStat) Collect() {
 		uint64(cpuinfo.cpu_ticks[C.CPU_STATE_NICE]) +
 		uint64(cpuinfo.cpu_ticks[C.CPU_STATE_IDLE]))
 
+	s.RecordCollect(nil)
 }
 
 // Usage returns current total CPU usage in percentage across all CPUs
@@ -4,9 +4,15 @@ package cpustat
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"math"
-	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/measure/metrics"
@@ -20,37 +26,76 @@ type CPUStat struct {
 	ProcsBlocked *metrics.Counter
 	cpus         map[string]*PerCPU
 	m            *metrics.MetricContext
+	mu           sync.RWMutex
+	fs           fs.FS
+	bootTime     time.Time
+	warm         chan struct{} // closed once warmed up
+	samples      int           // successful collections, up to warmupSamples
+	opts         misc.Options
+	misc.CollectStatus
+	misc.StepTicker
 }
 
 // PerCPU encapsulates metrics about individual CPU performance
 // and also provides few summary statistics
 type PerCPU struct {
-	User        *metrics.Counter
-	UserLowPrio *metrics.Counter
-	System      *metrics.Counter
-	Idle        *metrics.Counter
-	Iowait      *metrics.Counter
-	Irq         *metrics.Counter
-	Softirq     *metrics.Counter
-	Steal       *metrics.Counter
-	Guest       *metrics.Counter
-	Total       *metrics.Counter // total jiffies
+	User        *metrics.Counter `kind:"raw"`
+	UserLowPrio *metrics.Counter `kind:"raw"`
+	System      *metrics.Counter `kind:"raw"`
+	Idle        *metrics.Counter `kind:"raw"`
+	Iowait      *metrics.Counter `kind:"raw"`
+	Irq         *metrics.Counter `kind:"raw"`
+	Softirq     *metrics.Counter `kind:"raw"`
+	Steal       *metrics.Counter `kind:"raw"`
+	Guest       *metrics.Counter `kind:"raw"`
+	GuestNice   *metrics.Counter `kind:"raw"`
+	Total       *metrics.Counter `kind:"raw"` // total jiffies
+	// user+nice+system+idle+iowait+irq+softirq+steal jiffies;
+	// guest time is already part of user and nice
+	TotalAll *metrics.Counter `kind:"raw"`
+	// from /proc/schedstat (needs CONFIG_SCHEDSTATS)
+	SchedRuntime    *metrics.Counter `kind:"raw"` // ns spent running tasks
+	SchedRundelay   *metrics.Counter `kind:"raw"` // ns tasks spent waiting to run
+	SchedTimeslices *metrics.Counter `kind:"raw"`
 	// Computed stats
 	UserspacePct *metrics.Gauge
 	KernelPct    *metrics.Gauge
 	UsagePct     *metrics.Gauge
+	IrqPct       *metrics.Gauge
+	SoftirqPct   *metrics.Gauge
+	NicePct      *metrics.Gauge
+	collected    time.Time     // last parseCPUline()
+	owner        *sync.RWMutex // CPUStat.mu, nil if standalone
+	opts         misc.Options
 }
 
 // New returns an instance of CPUStat
-func New(m *metrics.MetricContext, Step time.Duration) *CPUStat {
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CPUStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewWithContext returns an instance of CPUStat which stops
+// collecting metrics once ctx is done
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CPUStat {
 	c := new(CPUStat)
-	c.All = NewPerCPU(m, "cpu")
+	c.opts = misc.NewOptions(opts...)
+	c.All = newPerCPU(m, "cpu", c.opts)
+	c.All.owner = &c.mu
 	c.m = m
 	c.cpus = make(map[string]*PerCPU, 1)
-	ticker := time.NewTicker(Step)
+	c.fs = misc.RootFS
+	c.warm = make(chan struct{})
+	ticker := c.StartTicker(Step, c.opts.Jitter)
 	go func() {
-		for _ = range ticker.C {
-			c.Collect()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Collect()
+				c.signalWarmup()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 	return c
@@ -60,16 +105,30 @@ func New(m *metrics.MetricContext, Step time.Duration) *CPUStat {
 // statistics
 // XXX: break this up into two smaller functions
 func (s *CPUStat) Collect() {
-	file, err := os.Open("/proc/stat")
-	defer file.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	file, err := s.fs.Open("proc/stat")
 	if err != nil {
+		s.RecordCollect(err)
 		return
 	}
+	defer file.Close()
+
+	// track cpus seen to drop the ones which went offline
+	seen := make(map[string]bool, len(s.cpus))
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		f := regexp.MustCompile("\\s+").Split(scanner.Text(), -1)
 
+		// boot time doesn't change, parse it once
+		if f[0] == "btime" && len(f) > 1 && s.bootTime.IsZero() {
+			if btime, err := misc.ParseUintErr(f[1]); err == nil {
+				s.bootTime = time.Unix(int64(btime), 0)
+			}
+			continue
+		}
+
 		isCPU, err := regexp.MatchString("^cpu\\d*", f[0])
 		if err == nil && isCPU {
 			if f[0] == "cpu" {
@@ -78,14 +137,111 @@ func (s *CPUStat) Collect() {
 			} else {
 				perCPU, ok := s.cpus[f[0]]
 				if !ok {
-					perCPU = NewPerCPU(s.m, f[0])
+					perCPU = newPerCPU(s.m, f[0], s.opts)
+					perCPU.owner = &s.mu
 					s.cpus[f[0]] = perCPU
 				}
+				seen[f[0]] = true
 				parseCPUline(perCPU, f)
 				populateComputedStats(perCPU)
 			}
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		s.RecordCollect(err)
+		return
+	}
+
+	for cpu, o := range s.cpus {
+		if !seen[cpu] {
+			misc.UnregisterMetricsOpts(o, s.m, "cpustat."+cpu, o.opts)
+			delete(s.cpus, cpu)
+		}
+	}
+	s.collectSchedstat()
+	s.RecordCollect(nil)
+}
+
+// collectSchedstat reads per-CPU run queue statistics from
+// /proc/schedstat, the file only exists with CONFIG_SCHEDSTATS.
+// The cpu<N> lines are
+//
+//	cpu<N> yld_count 0 sched_count sched_goidle ttwu_count ttwu_local
+//	       rq_cpu_time run_delay pcount
+//
+// and All gets the sum over all CPUs. Must be called with s.mu held
+func (s *CPUStat) collectSchedstat() {
+	file, err := s.fs.Open("proc/schedstat")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var run, delay, slices uint64
+	var found bool
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 10 || !strings.HasPrefix(f[0], "cpu") {
+			continue
+		}
+		o, ok := s.cpus[f[0]]
+		if !ok {
+			continue
+		}
+		o.SchedRuntime.Set(misc.ParseUint(f[7]))
+		o.SchedRundelay.Set(misc.ParseUint(f[8]))
+		o.SchedTimeslices.Set(misc.ParseUint(f[9]))
+		run += o.SchedRuntime.Get()
+		delay += o.SchedRundelay.Get()
+		slices += o.SchedTimeslices.Get()
+		found = true
+	}
+	if found {
+		s.All.SchedRuntime.Set(run)
+		s.All.SchedRundelay.Set(delay)
+		s.All.SchedTimeslices.Set(slices)
+	}
+}
+
+// Reset discards all per-CPU statistics and unregisters their
+// metrics; they are recreated by the next Collect()
+func (s *CPUStat) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for cpu, o := range s.cpus {
+		misc.UnregisterMetricsOpts(o, s.m, "cpustat."+cpu, o.opts)
+	}
+	s.cpus = make(map[string]*PerCPU, 1)
+}
+
+// SetFS makes Collect() read proc/stat from fsys instead of the
+// real filesystem, e.g. os.DirFS("/tmp/snapshot") for offline
+// analysis of a captured /proc
+func (s *CPUStat) SetFS(fsys fs.FS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fs = fsys
+}
+
+// SampleUsage returns total CPU usage in percentage across all
+// CPUs over interval by reading /proc/stat twice. It doesn't need
+// a MetricContext and registers no metrics, e.g. for short-lived
+// tools
+func SampleUsage(interval time.Duration) (float64, error) {
+	busy0, total0, err := readCPUTimes()
+	if err != nil {
+		return math.NaN(), err
+	}
+	time.Sleep(interval)
+	busy1, total1, err := readCPUTimes()
+	if err != nil {
+		return math.NaN(), err
+	}
+	if total1 <= total0 {
+		return math.NaN(), errors.New("no CPU time elapsed")
+	}
+	return float64(busy1-busy0) / float64(total1-total0) * 100, nil
 }
 
 // Usage returns current total CPU usage in percentage across all CPUs
@@ -105,9 +261,12 @@ func (s *CPUStat) Kernel() float64 {
 	return s.All.Kernel()
 }
 
-// CPUS returns all CPUS found as a slice of strings
+// CPUS returns all CPUS found as a slice of strings. The
+// slice is a snapshot and is not updated by Collect()
 func (s *CPUStat) CPUS() []string {
-	ret := make([]string, 1)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0, len(s.cpus))
 	for k := range s.cpus {
 		ret = append(ret, k)
 	}
@@ -115,18 +274,109 @@ func (s *CPUStat) CPUS() []string {
 	return ret
 }
 
+// BootTime returns the time the system booted (btime from
+// /proc/stat) or the zero time before the first Collect()
+func (s *CPUStat) BootTime() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bootTime
+}
+
+// Uptime returns time elapsed since BootTime(), 0 if it
+// isn't known yet
+func (s *CPUStat) Uptime() time.Duration {
+	bt := s.BootTime()
+	if bt.IsZero() {
+		return 0
+	}
+	return misc.Since(bt)
+}
+
+// IdleCPUs returns the sorted names of CPUs which were idle
+// more than threshold percent of the time. CPUs without two
+// samples yet are never reported idle
+func (s *CPUStat) IdleCPUs(threshold float64) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]string, 0)
+	for k, o := range s.cpus {
+		if o.IsIdle(threshold) {
+			ret = append(ret, k)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// TotalCPUs returns the number of CPUs listed in /proc/stat,
+// which is unaffected by GOMAXPROCS or cpuset restrictions
+// unlike runtime.NumCPU(). It is 0 until the first Collect()
+func (s *CPUStat) TotalCPUs() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.cpus)
+}
+
+// OnlineCPUs returns the number of CPUs currently online
+// according to /sys/devices/system/cpu/online, 0 if it
+// can't be read
+func (s *CPUStat) OnlineCPUs() int {
+	return misc.OnlineCPUs()
+}
+
 // PerCPUStat returns per-CPU stats for argument "cpu"
 func (s *CPUStat) PerCPUStat(cpu string) *PerCPU {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.cpus[cpu]
 }
 
+// CPUSnapshot holds computed statistics of a CPU
+type CPUSnapshot struct {
+	UsagePct     misc.JSONFloat `json:"usage_pct"`
+	UserspacePct misc.JSONFloat `json:"userspace_pct"`
+	KernelPct    misc.JSONFloat `json:"kernel_pct"`
+}
+
+// Snapshot holds computed statistics for all CPUs (All)
+// and for each individual CPU keyed by name e.g. "cpu0"
+type Snapshot struct {
+	All  CPUSnapshot            `json:"all"`
+	CPUs map[string]CPUSnapshot `json:"cpus"`
+}
+
+// Snapshot returns current computed statistics. It is safe
+// to call concurrently with Collect
+func (s *CPUStat) Snapshot() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r := new(Snapshot)
+	r.All = s.All.snapshot()
+	r.CPUs = make(map[string]CPUSnapshot, len(s.cpus))
+	for k, o := range s.cpus {
+		r.CPUs[k] = o.snapshot()
+	}
+	return r
+}
+
+// MarshalJSON encodes Snapshot() as JSON
+func (s *CPUStat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
+
 // NewPerCPU returns a struct representing counters for
 // per CPU statistics
 func NewPerCPU(m *metrics.MetricContext, name string) *PerCPU {
+	return newPerCPU(m, name, misc.Options{})
+}
+
+func newPerCPU(m *metrics.MetricContext, name string, opts misc.Options) *PerCPU {
 	o := new(PerCPU)
+	o.opts = opts
 
 	// initialize all metrics and register them
-	misc.InitializeMetrics(o, m, "cpustat."+name, true)
+	misc.InitializeMetricsOpts(o, m, "cpustat."+name, true, opts)
 	return o
 }
 
@@ -167,22 +417,199 @@ func (o *PerCPU) Kernel() float64 {
 	return math.NaN()
 }
 
+// IdleUsage returns percentage of time this CPU was idle, out
+// of all its time (TotalAll) like IowaitUsage() so the two can
+// be compared. The Idle() name is taken by the counter
+func (o *PerCPU) IdleUsage() float64 {
+	i := o.Idle.ComputeRate()
+	t := o.TotalAll.ComputeRate()
+	if !math.IsNaN(i) && !math.IsNaN(t) && t > 0 {
+		return (i / t) * 100
+	}
+	return math.NaN()
+}
+
+// IsIdle returns true if the CPU was idle more than threshold
+// percent of the time, false without two samples yet
+func (o *PerCPU) IsIdle(threshold float64) bool {
+	return isIdle(o.IdleUsage(), threshold)
+}
+
+// IrqUsage returns percentage of time spent servicing hardware
+// interrupts on this CPU, out of all its time (TotalAll)
+func (o *PerCPU) IrqUsage() float64 {
+	i := o.Irq.ComputeRate()
+	t := o.TotalAll.ComputeRate()
+	if !math.IsNaN(i) && !math.IsNaN(t) && t > 0 {
+		return (i / t) * 100
+	}
+	return math.NaN()
+}
+
+// SoftirqUsage returns percentage of time spent servicing software
+// interrupts (e.g. network receive processing) on this CPU, out of
+// all its time (TotalAll)
+func (o *PerCPU) SoftirqUsage() float64 {
+	i := o.Softirq.ComputeRate()
+	t := o.TotalAll.ComputeRate()
+	if !math.IsNaN(i) && !math.IsNaN(t) && t > 0 {
+		return (i / t) * 100
+	}
+	return math.NaN()
+}
+
+// IowaitUsage returns percentage of time this CPU was idle
+// while tasks waited for I/O to complete, out of all its time
+// (TotalAll). The Iowait() name is taken by the counter
+func (o *PerCPU) IowaitUsage() float64 {
+	i := o.Iowait.ComputeRate()
+	t := o.TotalAll.ComputeRate()
+	if !math.IsNaN(i) && !math.IsNaN(t) && t > 0 {
+		return (i / t) * 100
+	}
+	return math.NaN()
+}
+
+// Nice returns percentage of time spent running niced (low
+// priority) userspace tasks on this CPU, out of all its time
+// (TotalAll). These ticks are also counted in UserSpace()
+func (o *PerCPU) Nice() float64 {
+	n := o.UserLowPrio.ComputeRate()
+	t := o.TotalAll.ComputeRate()
+	if !math.IsNaN(n) && !math.IsNaN(t) && t > 0 {
+		return (n / t) * 100
+	}
+	return math.NaN()
+}
+
+// RunQueueWaitRate returns seconds per second that runnable tasks
+// spent waiting for this CPU, i.e. the average number of tasks
+// waiting in its run queue. NaN without /proc/schedstat
+func (o *PerCPU) RunQueueWaitRate() float64 {
+	return o.SchedRundelay.ComputeRate() / 1e9
+}
+
+// CPUSample holds the raw tick counters of a CPU as of the
+// last Collect(), see PerCPU.Sample(). Time is when Collect()
+// read them
+type CPUSample struct {
+	Time        time.Time
+	User        uint64
+	UserLowPrio uint64
+	System      uint64
+	Idle        uint64
+	Iowait      uint64
+	Irq         uint64
+	Softirq     uint64
+	Steal       uint64
+	Guest       uint64
+	GuestNice   uint64
+	Total       uint64
+}
+
+// Sample captures the current tick counters. Together with Rate()
+// this computes usage between two explicit points, e.g. Collect(),
+// Sample(), sleep, Collect(), Sample(), rather than between the last
+// two Collect() calls of the ticker as Usage() and the other
+// ComputeRate() based methods do. Keeping samples around also
+// allows rates over custom windows, dividing tick deltas by
+// LINUX_TICKS_IN_SEC and the Time delta. All counters come from
+// the same Collect(), it is safe to call concurrently with it
+func (o *PerCPU) Sample() CPUSample {
+	if o.owner != nil {
+		o.owner.RLock()
+		defer o.owner.RUnlock()
+	}
+	return CPUSample{
+		Time:        o.collected,
+		User:        o.User.Get(),
+		UserLowPrio: o.UserLowPrio.Get(),
+		System:      o.System.Get(),
+		Idle:        o.Idle.Get(),
+		Iowait:      o.Iowait.Get(),
+		Irq:         o.Irq.Get(),
+		Softirq:     o.Softirq.Get(),
+		Steal:       o.Steal.Get(),
+		Guest:       o.Guest.Get(),
+		GuestNice:   o.GuestNice.Get(),
+		Total:       o.Total.Get(),
+	}
+}
+
+// Rate returns usage percentages between samples a and b taken
+// from the same CPU, a being the older one. Percentages are
+// ratios of tick deltas so the sample times only matter to
+// order them. All values are NaN if no ticks elapsed
+func Rate(a, b CPUSample) CPUSnapshot {
+	if b.Total <= a.Total {
+		nan := misc.JSONFloat(math.NaN())
+		return CPUSnapshot{UsagePct: nan, UserspacePct: nan, KernelPct: nan}
+	}
+	t := float64(b.Total - a.Total)
+	u := float64(b.User - a.User)
+	n := float64(b.UserLowPrio - a.UserLowPrio)
+	s := float64(b.System - a.System)
+	return CPUSnapshot{
+		UsagePct:     misc.JSONFloat((u + n + s) / t * 100),
+		UserspacePct: misc.JSONFloat((u + n) / t * 100),
+		KernelPct:    misc.JSONFloat(s / t * 100),
+	}
+}
+
 // Unexported functions
+func (o *PerCPU) snapshot() CPUSnapshot {
+	return CPUSnapshot{
+		UsagePct:     misc.JSONFloat(o.UsagePct.Get()),
+		UserspacePct: misc.JSONFloat(o.UserspacePct.Get()),
+		KernelPct:    misc.JSONFloat(o.KernelPct.Get()),
+	}
+}
+
+// isIdle is IsIdle() for an IdleUsage() of idle percent
+func isIdle(idle, threshold float64) bool {
+	return !math.IsNaN(idle) && idle > threshold
+}
+
+// readCPUTimes returns user+nice+system and their sum with idle
+// from the "cpu" line of /proc/stat, as used by PerCPU.Usage()
+func readCPUTimes() (busy, total uint64, err error) {
+	f, err := misc.ReadFieldsFromFile("/proc/stat", "")
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(f) < 5 || f[0] != "cpu" {
+		return 0, 0, errors.New("unexpected /proc/stat format")
+	}
+	busy = misc.ParseUint(f[1]) + misc.ParseUint(f[2]) + misc.ParseUint(f[3])
+	return busy, busy + misc.ParseUint(f[4]), nil
+}
+
+// parseCPUline parses a "cpuN user nice system ..." line. Older
+// kernels have fewer columns (steal appeared in 2.6.11, guest in
+// 2.6.24, guest_nice in 2.6.33); missing ones are set to 0 and
+// columns added by newer kernels are ignored
 func parseCPUline(s *PerCPU, f []string) {
-	s.User.Set(misc.ParseUint(f[1]))
-	s.UserLowPrio.Set(misc.ParseUint(f[2]))
-	s.System.Set(misc.ParseUint(f[3]))
-	s.Idle.Set(misc.ParseUint(f[4]))
-	s.Iowait.Set(misc.ParseUint(f[5]))
-	s.Irq.Set(misc.ParseUint(f[6]))
-	s.Softirq.Set(misc.ParseUint(f[7]))
-	s.Steal.Set(misc.ParseUint(f[8]))
-	s.Guest.Set(misc.ParseUint(f[9]))
+	columns := []*metrics.Counter{s.User, s.UserLowPrio, s.System,
+		s.Idle, s.Iowait, s.Irq, s.Softirq, s.Steal, s.Guest,
+		s.GuestNice}
+	for i, c := range columns {
+		if i+1 < len(f) {
+			c.Set(misc.ParseUint(f[i+1]))
+		} else {
+			c.Set(0)
+		}
+	}
 	s.Total.Set(s.User.Get() + s.UserLowPrio.Get() + s.System.Get() + s.Idle.Get())
+	s.TotalAll.Set(s.Total.Get() + s.Iowait.Get() + s.Irq.Get() +
+		s.Softirq.Get() + s.Steal.Get())
+	s.collected = misc.Now()
 }
 
 func populateComputedStats(s *PerCPU) {
 	s.UserspacePct.Set(s.UserSpace())
 	s.KernelPct.Set(s.Kernel())
 	s.UsagePct.Set(s.Usage())
+	s.IrqPct.Set(s.IrqUsage())
+	s.SoftirqPct.Set(s.SoftirqUsage())
+	s.NicePct.Set(s.Nice())
 }
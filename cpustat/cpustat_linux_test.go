@@ -0,0 +1,402 @@
+// Copyright (c) 2014 Square, Inc
+
+package cpustat
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/misc"
+)
+
+const statTwoCPUs = `cpu  200 0 100 1000 0 0 0 0 0 0
+cpu0 100 0 50 500 0 0 0 0 0 0
+cpu1 100 0 50 500 0 0 0 0 0 0
+btime 1700000000
+`
+
+const statOneCPU = `cpu  300 0 150 1500 0 0 0 0 0 0
+cpu0 150 0 75 750 0 0 0 0 0 0
+btime 1700000000
+`
+
+// newTestCPUStat returns a CPUStat reading proc/stat from fsys
+// which only collects when Collect() is called
+func newTestCPUStat(t *testing.T, fsys fstest.MapFS) (*CPUStat, *metrics.MetricContext) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m := metrics.NewMetricContext("test")
+	s := NewWithContext(ctx, m, time.Hour)
+	s.SetFS(fsys)
+	return s, m
+}
+
+func registered(m *metrics.MetricContext, name string) bool {
+	_, ok := m.Counters[name]
+	return ok
+}
+
+func TestCollectHotplug(t *testing.T) {
+	fsys := fstest.MapFS{"proc/stat": {Data: []byte(statTwoCPUs)}}
+	s, m := newTestCPUStat(t, fsys)
+
+	s.Collect()
+	if n := s.TotalCPUs(); n != 2 {
+		t.Fatalf("TotalCPUs() = %d, want 2", n)
+	}
+	if !registered(m, "cpustat.cpu1.User") {
+		t.Fatalf("cpustat.cpu1.User not registered")
+	}
+	before := len(m.Counters)
+
+	// cpu1 unplugged
+	fsys["proc/stat"] = &fstest.MapFile{Data: []byte(statOneCPU)}
+	s.Collect()
+	if n := s.TotalCPUs(); n != 1 {
+		t.Fatalf("TotalCPUs() = %d after unplug, want 1", n)
+	}
+	if registered(m, "cpustat.cpu1.User") {
+		t.Errorf("cpustat.cpu1.User still registered after unplug")
+	}
+	if !registered(m, "cpustat.cpu0.User") {
+		t.Errorf("cpustat.cpu0.User unregistered after unplug")
+	}
+	if len(m.Counters) >= before {
+		t.Errorf("%d counters registered after unplug, want fewer than %d",
+			len(m.Counters), before)
+	}
+
+	// and plugged back in
+	fsys["proc/stat"] = &fstest.MapFile{Data: []byte(statTwoCPUs)}
+	s.Collect()
+	if s.PerCPUStat("cpu1") == nil || !registered(m, "cpustat.cpu1.User") {
+		t.Errorf("cpu1 not tracked again after replug")
+	}
+	if len(m.Counters) != before {
+		t.Errorf("%d counters registered after replug, want %d",
+			len(m.Counters), before)
+	}
+}
+
+func TestReset(t *testing.T) {
+	fsys := fstest.MapFS{"proc/stat": {Data: []byte(statTwoCPUs)}}
+	s, m := newTestCPUStat(t, fsys)
+
+	s.Collect()
+	s.Reset()
+	if n := s.TotalCPUs(); n != 0 {
+		t.Errorf("TotalCPUs() = %d after Reset(), want 0", n)
+	}
+	for _, name := range []string{"cpustat.cpu0.User", "cpustat.cpu1.User"} {
+		if registered(m, name) {
+			t.Errorf("%s still registered after Reset()", name)
+		}
+	}
+	if !registered(m, "cpustat.cpu.User") {
+		t.Errorf("cpustat.cpu.User of All unregistered by Reset()")
+	}
+}
+
+func TestWithoutRawMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := metrics.NewMetricContext("test")
+	s := NewWithContext(ctx, m, time.Hour, misc.WithoutRawMetrics())
+	s.SetFS(fstest.MapFS{"proc/stat": {Data: []byte(statTwoCPUs)}})
+	s.Collect()
+
+	for _, name := range []string{"cpustat.cpu.User", "cpustat.cpu0.User",
+		"cpustat.cpu0.Total", "cpustat.cpu0.SchedRuntime"} {
+		if registered(m, name) {
+			t.Errorf("raw metric %s registered", name)
+		}
+	}
+	for _, name := range []string{"cpustat.cpu.UsagePct", "cpustat.cpu0.UsagePct",
+		"cpustat.cpu1.IrqPct"} {
+		if _, ok := m.Gauges[name]; !ok {
+			t.Errorf("%s not registered", name)
+		}
+	}
+	if s.All.User.Get() != 200 {
+		t.Errorf("All.User = %d, want 200 although unregistered", s.All.User.Get())
+	}
+}
+
+func TestSampleFakeClock(t *testing.T) {
+	fake := misc.NewFakeClock(time.Unix(1700000000, 0))
+	defer misc.SetClock(fake)()
+
+	fsys := fstest.MapFS{"proc/stat": {Data: []byte(statTwoCPUs)}}
+	s, _ := newTestCPUStat(t, fsys)
+	s.Collect()
+	a := s.All.Sample()
+
+	fake.Advance(10 * time.Second)
+	fsys["proc/stat"] = &fstest.MapFile{Data: []byte(statOneCPU)}
+	s.Collect()
+	b := s.All.Sample()
+
+	if d := b.Time.Sub(a.Time); d != 10*time.Second {
+		t.Errorf("samples %v apart, want 10s", d)
+	}
+	// 150 busy out of 650 jiffies
+	r := Rate(a, b)
+	if want := 150.0 / 650 * 100; float64(r.UsagePct) != want {
+		t.Errorf("UsagePct = %v, want %v", r.UsagePct, want)
+	}
+	user := misc.Rate(misc.Sample{Value: a.User, Time: a.Time},
+		misc.Sample{Value: b.User, Time: b.Time})
+	if user != 10 {
+		t.Errorf("user jiffies per second = %v, want 10", user)
+	}
+}
+
+// TestConcurrentAccess is meant for go test -race
+func TestConcurrentAccess(t *testing.T) {
+	fsys := fstest.MapFS{"proc/stat": {Data: []byte(statTwoCPUs)}}
+	s, _ := newTestCPUStat(t, fsys)
+	s.Collect()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			// alternate between two and one CPU to add and
+			// remove map entries
+			if i%2 == 0 {
+				s.SetFS(fstest.MapFS{"proc/stat": {Data: []byte(statOneCPU)}})
+			} else {
+				s.SetFS(fstest.MapFS{"proc/stat": {Data: []byte(statTwoCPUs)}})
+			}
+			s.Collect()
+			if i%50 == 0 {
+				s.Reset()
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.Usage()
+				s.CPUS()
+				s.IdleCPUs(10)
+				s.TotalCPUs()
+				if o := s.PerCPUStat("cpu1"); o != nil {
+					o.Usage()
+				}
+				s.Snapshot()
+				if _, err := s.MarshalJSON(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSampleConcurrent(t *testing.T) {
+	fsys := fstest.MapFS{"proc/stat": {Data: []byte(statTwoCPUs)}}
+	s, _ := newTestCPUStat(t, fsys)
+	s.Collect()
+
+	// every sample must come from a single Collect(), run with
+	// -race
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			a := s.All.Sample()
+			if sum := a.User + a.UserLowPrio + a.System + a.Idle; sum != a.Total {
+				t.Errorf("sample mixes collections: user+nice+system+idle = %d, Total = %d", sum, a.Total)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		stat := statTwoCPUs
+		if i%2 == 0 {
+			stat = statOneCPU
+		}
+		fsys["proc/stat"] = &fstest.MapFile{Data: []byte(stat)}
+		s.Collect()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestParseCPUline(t *testing.T) {
+	tests := []struct {
+		line string
+		// user nice system idle iowait irq softirq steal guest
+		// guest_nice
+		want     [10]uint64
+		total    uint64
+		totalAll uint64
+	}{
+		{
+			// 2.6.11, no guest columns
+			line:     "cpu0 10 2 5 100 3 1 4 6",
+			want:     [10]uint64{10, 2, 5, 100, 3, 1, 4, 6, 0, 0},
+			total:    117,
+			totalAll: 131,
+		},
+		{
+			// 2.6.24, guest but no guest_nice
+			line:     "cpu0 10 2 5 100 3 1 4 6 7",
+			want:     [10]uint64{10, 2, 5, 100, 3, 1, 4, 6, 7, 0},
+			total:    117,
+			totalAll: 131,
+		},
+		{
+			// 2.6.33 and later
+			line:     "cpu0 10 2 5 100 3 1 4 6 7 1",
+			want:     [10]uint64{10, 2, 5, 100, 3, 1, 4, 6, 7, 1},
+			total:    117,
+			totalAll: 131,
+		},
+		{
+			// columns added by newer kernels are ignored
+			line:     "cpu0 10 2 5 100 3 1 4 6 7 1 99",
+			want:     [10]uint64{10, 2, 5, 100, 3, 1, 4, 6, 7, 1},
+			total:    117,
+			totalAll: 131,
+		},
+	}
+	for _, tt := range tests {
+		o := NewPerCPU(metrics.NewMetricContext("test"), "cpu0")
+		// a previous line with more columns must not leak into
+		// the missing ones
+		parseCPUline(o, strings.Fields("cpu0 1 1 1 1 1 1 1 1 1 1"))
+		parseCPUline(o, strings.Fields(tt.line))
+		got := [10]uint64{o.User.Get(), o.UserLowPrio.Get(), o.System.Get(),
+			o.Idle.Get(), o.Iowait.Get(), o.Irq.Get(), o.Softirq.Get(),
+			o.Steal.Get(), o.Guest.Get(), o.GuestNice.Get()}
+		if got != tt.want {
+			t.Errorf("parseCPUline(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+		if v := o.Total.Get(); v != tt.total {
+			t.Errorf("parseCPUline(%q) Total = %d, want %d", tt.line, v, tt.total)
+		}
+		if v := o.TotalAll.Get(); v != tt.totalAll {
+			t.Errorf("parseCPUline(%q) TotalAll = %d, want %d", tt.line, v, tt.totalAll)
+		}
+	}
+}
+
+func TestIsIdle(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		idle, threshold float64
+		want            bool
+	}{
+		{75, 74.9, true},
+		// strictly more than threshold
+		{75, 75, false},
+		{75, 75.1, false},
+		{0, 0, false},
+		{100, 99.99, true},
+		{100, 100, false},
+		// no two samples yet
+		{nan, 0, false},
+		{nan, -1, false},
+	}
+	for _, tt := range tests {
+		if got := isIdle(tt.idle, tt.threshold); got != tt.want {
+			t.Errorf("isIdle(%v, %v) = %v, want %v", tt.idle, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestIdleCPUs(t *testing.T) {
+	fsys := fstest.MapFS{"proc/stat": {Data: []byte(`cpu  0 0 0 0 0 0 0 0 0 0
+cpu0 0 0 0 0 0 0 0 0 0 0
+cpu1 0 0 0 0 0 0 0 0 0 0
+`)}}
+	s, _ := newTestCPUStat(t, fsys)
+	s.Collect()
+	if got := s.IdleCPUs(-1); len(got) != 0 {
+		t.Errorf("IdleCPUs() = %v after one sample, want none", got)
+	}
+
+	// rates are computed from the time of each counter update,
+	// keep the interval long enough for their skew not to matter
+	time.Sleep(50 * time.Millisecond)
+	// cpu0 75% idle out of all its time: 150 of 200 ticks, 88%
+	// of user+nice+system+idle only. cpu1 25% idle
+	fsys["proc/stat"] = &fstest.MapFile{Data: []byte(`cpu  110 0 60 200 20 5 5 0 0 0
+cpu0 10 0 10 150 20 5 5 0 0 0
+cpu1 100 0 50 50 0 0 0 0 0 0
+`)}
+	s.Collect()
+
+	if v := s.PerCPUStat("cpu0").IdleUsage(); math.Abs(v-75) > 0.1 {
+		t.Errorf("cpu0 IdleUsage() = %v, want 75", v)
+	}
+	tests := []struct {
+		threshold float64
+		want      []string
+	}{
+		{10, []string{"cpu0", "cpu1"}},
+		{24, []string{"cpu0", "cpu1"}},
+		{26, []string{"cpu0"}},
+		{74, []string{"cpu0"}},
+		{76, []string{}},
+		{100, []string{}},
+	}
+	for _, tt := range tests {
+		got := s.IdleCPUs(tt.threshold)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("IdleCPUs(%v) = %v, want %v", tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestNice(t *testing.T) {
+	fsys := fstest.MapFS{"proc/stat": {Data: []byte(`cpu  0 0 0 0 0 0 0 0 0 0
+cpu0 0 0 0 0 0 0 0 0 0 0
+`)}}
+	s, m := newTestCPUStat(t, fsys)
+	s.Collect()
+	o := s.PerCPUStat("cpu0")
+	if v := o.Nice(); !math.IsNaN(v) {
+		t.Errorf("Nice() = %v after one sample, want NaN", v)
+	}
+
+	// see TestIdleCPUs
+	time.Sleep(50 * time.Millisecond)
+	// 40 niced ticks out of 200, 22% of user+nice+system+idle only
+	fsys["proc/stat"] = &fstest.MapFile{Data: []byte(`cpu  20 40 20 100 10 5 5 0 0 0
+cpu0 20 40 20 100 10 5 5 0 0 0
+`)}
+	s.Collect()
+	if v := o.Nice(); math.Abs(v-20) > 0.1 {
+		t.Errorf("Nice() = %v, want 20", v)
+	}
+	if v := m.Gauges["cpustat.cpu0.NicePct"].Get(); math.Abs(v-20) > 0.1 {
+		t.Errorf("NicePct = %v, want 20", v)
+	}
+}
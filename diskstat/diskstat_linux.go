@@ -4,31 +4,53 @@ package diskstat
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/measure/os/misc"
 	"github.com/measure/metrics"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
 	"time"
 )
 
+// sector size used by /proc/diskstats regardless of the
+// device's actual sector size
+const sectorSize = 512
+
 type DiskStat struct {
-	Disks   map[string]*PerDiskStat
-	m       *metrics.MetricContext
-	blkdevs map[string]bool
+	Disks             map[string]*PerDiskStat
+	m                 *metrics.MetricContext
+	mu                sync.RWMutex // guards includePartitions and blkdevs
+	includePartitions bool         // see SetIncludePartitions()
+	blkdevs           map[string]bool
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *DiskStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
 }
 
-func New(m *metrics.MetricContext, Step time.Duration) *DiskStat {
+// NewWithContext returns an instance of DiskStat which stops
+// collecting metrics once ctx is done
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *DiskStat {
 	s := new(DiskStat)
 	s.Disks = make(map[string]*PerDiskStat, 6)
 	s.m = m
 	s.RefreshBlkDevList() // perhaps call this once in a while
 
-	ticker := time.NewTicker(Step)
+	ticker := s.StartTicker(Step, misc.NewOptions(opts...).Jitter)
 	go func() {
-		for _ = range ticker.C {
-			s.Collect()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Collect()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -46,16 +68,32 @@ func (s *DiskStat) RefreshBlkDevList() {
 		}
 	}
 
+	s.mu.Lock()
 	s.blkdevs = blkdevs
+	s.mu.Unlock()
+}
+
+// SetIncludePartitions makes Collect() track partitions (e.g. sda1)
+// in addition to whole disks listed in /sys/block, from the next
+// Collect() on
+func (s *DiskStat) SetIncludePartitions(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.includePartitions = v
 }
 
 func (s *DiskStat) Collect() {
 	file, err := os.Open("/proc/diskstats")
 	defer file.Close()
 	if err != nil {
+		s.RecordCollect(err)
 		return
 	}
 
+	s.mu.RLock()
+	blkdevs, includePartitions := s.blkdevs, s.includePartitions
+	s.mu.RUnlock()
+
 	var blkdev string
 	var major, minor uint64
 	var f [11]uint64
@@ -73,8 +111,9 @@ func (s *DiskStat) Collect() {
 		}
 
 		// skip collecting for individual partitions
-		_, ok := s.blkdevs[blkdev]
-		if !ok {
+		// unless asked to
+		_, ok := blkdevs[blkdev]
+		if !ok && !includePartitions {
 			continue
 		}
 
@@ -84,6 +123,14 @@ func (s *DiskStat) Collect() {
 			s.Disks[blkdev] = o
 		}
 
+		o.mu.Lock()
+		for i := range f {
+			// f[8] is a gauge
+			if i != 8 {
+				f[i] = o.wrap[i].Update(f[i])
+			}
+		}
+
 		d := o.Metrics
 		d.ReadCompleted.Set(f[0])
 		d.ReadMerged.Set(f[1])
@@ -96,12 +143,20 @@ func (s *DiskStat) Collect() {
 		d.IOInProgress.Set(float64(f[8]))
 		d.IOSpentMsecs.Set(f[9])
 		d.WeightedIOSpentMsecs.Set(f[10])
+		o.collected = misc.Now()
+		o.mu.Unlock()
 	}
+	s.RecordCollect(scanner.Err())
 }
 
 type PerDiskStat struct {
-	Metrics *PerDiskStatMetrics
-	m       *metrics.MetricContext
+	Metrics   *PerDiskStatMetrics
+	m         *metrics.MetricContext
+	mu        sync.RWMutex // held by Collect() while updating, see Sample()
+	collected time.Time    // last Collect() which saw the device
+	// /proc/diskstats fields are unsigned long and wrap at 32
+	// bits on 32 bit kernels
+	wrap [11]misc.WrapCounter
 }
 
 type PerDiskStatMetrics struct {
@@ -132,3 +187,70 @@ func (s *PerDiskStat) Usage() float64 {
 	o := s.Metrics
 	return ((o.IOSpentMsecs.ComputeRate()) / 1000) * 100
 }
+
+// Utilization returns percentage of time the device had IO
+// in flight (io_time rate). Same as Usage()
+func (s *PerDiskStat) Utilization() float64 {
+	return s.Usage()
+}
+
+// ReadBytesRate returns bytes read per second
+func (s *PerDiskStat) ReadBytesRate() float64 {
+	return s.Metrics.ReadSectors.ComputeRate() * sectorSize
+}
+
+// WriteBytesRate returns bytes written per second
+func (s *PerDiskStat) WriteBytesRate() float64 {
+	return s.Metrics.WriteSectors.ComputeRate() * sectorSize
+}
+
+// ReadIOPS returns completed reads per second
+func (s *PerDiskStat) ReadIOPS() float64 {
+	return s.Metrics.ReadCompleted.ComputeRate()
+}
+
+// WriteIOPS returns completed writes per second
+func (s *PerDiskStat) WriteIOPS() float64 {
+	return s.Metrics.WriteCompleted.ComputeRate()
+}
+
+// DiskSample holds the raw cumulative counters of a device as of
+// the last Collect(), see PerDiskStat.Sample(). Time is when
+// Collect() read them
+type DiskSample struct {
+	Time                 time.Time
+	ReadCompleted        uint64
+	ReadMerged           uint64
+	ReadSectors          uint64
+	ReadSpentMsecs       uint64
+	WriteCompleted       uint64
+	WriteMerged          uint64
+	WriteSectors         uint64
+	WriteSpentMsecs      uint64
+	IOSpentMsecs         uint64
+	WeightedIOSpentMsecs uint64
+}
+
+// Sample captures the current counters. The difference of two
+// samples over their Time delta gives rates over any window,
+// unlike the ComputeRate() based methods which only cover the
+// last two Collect() calls. All counters come from the same
+// Collect(), it is safe to call concurrently with it
+func (s *PerDiskStat) Sample() DiskSample {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o := s.Metrics
+	return DiskSample{
+		Time:                 s.collected,
+		ReadCompleted:        o.ReadCompleted.Get(),
+		ReadMerged:           o.ReadMerged.Get(),
+		ReadSectors:          o.ReadSectors.Get(),
+		ReadSpentMsecs:       o.ReadSpentMsecs.Get(),
+		WriteCompleted:       o.WriteCompleted.Get(),
+		WriteMerged:          o.WriteMerged.Get(),
+		WriteSectors:         o.WriteSectors.Get(),
+		WriteSpentMsecs:      o.WriteSpentMsecs.Get(),
+		IOSpentMsecs:         o.IOSpentMsecs.Get(),
+		WeightedIOSpentMsecs: o.WeightedIOSpentMsecs.Get(),
+	}
+}
@@ -5,28 +5,88 @@ package fsstat
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"github.com/measure/metrics"
 	"github.com/measure/os/misc"
-	"os"
+	"io/fs"
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
+// DefaultExcludeDevices lists pseudo devices skipped by Collect()
+// unless changed with FSStat.SetExclude():
+// proc, sysfs, devpts, none, sunrpc
+var DefaultExcludeDevices = []string{"proc", "sysfs", "devpts", "none", "sunrpc"}
+
+// DefaultExcludeFSTypes lists filesystem types skipped by Collect()
+// unless changed with FSStat.SetExclude() (man fstab):
+// swap, bind, ignore, none
+var DefaultExcludeFSTypes = []string{"swap", "bind", "ignore", "none"}
+
+// NetworkFSTypes lists filesystem types treated as network
+// filesystems. These are skipped unless enabled with
+// FSStat.SetNetworkFS() since statfs on a hung server can block
+// indefinitely
+var NetworkFSTypes = []string{"nfs", "nfs4", "cifs", "fuse.sshfs"}
+
+// DefaultNetworkFSTimeout is the default time to wait for statfs
+// on a network filesystem before giving up on that sample
+const DefaultNetworkFSTimeout = 5 * time.Second
+
+// FSStat tracks mounted filesystems. FS is updated by Collect();
+// use the accessor methods rather than reading it directly from
+// another goroutine
 type FSStat struct {
 	FS map[string]*PerFSStat
-	m  *metrics.MetricContext
+	// see SetExclude()
+	excludeDevices []string
+	excludeFSTypes []string
+	// see SetExcludeMountGlobs()
+	excludeMountGlobs []string
+	// see SetNetworkFS()
+	includeNetworkFS bool
+	networkFSTimeout time.Duration
+	m                *metrics.MetricContext
+	mu               sync.RWMutex // guards FS, fs and the settings
+	collectMu        sync.Mutex   // serializes Collect()
+	fs               fs.FS
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *FSStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
 }
 
-func New(m *metrics.MetricContext, Step time.Duration) *FSStat {
+// NewWithContext returns an instance of FSStat which stops
+// collecting metrics once ctx is done
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *FSStat {
 	s := new(FSStat)
 	s.FS = make(map[string]*PerFSStat, 0)
 	s.m = m
+	s.excludeDevices = append([]string(nil), DefaultExcludeDevices...)
+	s.excludeFSTypes = append([]string(nil), DefaultExcludeFSTypes...)
+	s.networkFSTimeout = DefaultNetworkFSTimeout
+	s.fs = misc.RootFS
 
-	ticker := time.NewTicker(Step)
+	ticker := s.StartTicker(Step, misc.NewOptions(opts...).Jitter)
 	go func() {
-		for _ = range ticker.C {
-			s.Collect()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Collect()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -34,58 +94,395 @@ func New(m *metrics.MetricContext, Step time.Duration) *FSStat {
 }
 
 func (s *FSStat) Collect() {
-	file, err := os.Open("/etc/mtab")
-	defer file.Close()
+	s.collectMu.Lock()
+	defer s.collectMu.Unlock()
+
+	s.mu.RLock()
+	fsys := s.fs
+	s.mu.RUnlock()
+	file, err := fsys.Open("proc/self/mountinfo")
 	if err != nil {
+		s.RecordCollect(err)
 		return
 	}
+	defer file.Close()
 
+	s.mu.Lock()
 	// mark all objects as non-mounted to weed out
 	// the ones that disappeared from last time we ran
 	for _, o := range s.FS {
-		o.IsMounted = false
+		o.setMounted(false)
 	}
 
+	var mounted []*PerFSStat
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		f := strings.Split(scanner.Text(), " ")
-
-		//TODO: XXX: exclusions should be configurable
+		mi, ok := parseMountInfo(scanner.Text())
+		if !ok {
+			continue
+		}
 
-		// ignore few device types
-		if f[0] == "proc" || f[0] == "sysfs" || f[0] == "devpts" ||
-			f[0] == "none" || f[0] == "sunrpc" {
+		// ignore excluded device and mount types
+		if contains(s.excludeDevices, mi.device) ||
+			contains(s.excludeFSTypes, mi.fstype) ||
+			matchesGlob(s.excludeMountGlobs, mi.mountpoint) {
 			continue
 		}
 
-		// ignore few types of mounts
-		// man fstab
-		if f[3] == "swap" || f[3] == "bind" || f[3] == "ignore" || f[3] == "none" {
+		isNetworkFS := contains(NetworkFSTypes, mi.fstype)
+		if isNetworkFS && !s.includeNetworkFS {
 			continue
 		}
 
-		o, ok := s.FS[f[1]]
+		o, ok := s.FS[mi.mountpoint]
 		if !ok {
-			o = NewPerFSStat(s.m, f[1])
-			s.FS[f[1]] = o
+			o = NewPerFSStat(s.m, mi.mountpoint)
+			s.FS[mi.mountpoint] = o
 		}
-		o.IsMounted = true
-		o.Collect()
+		o.update(mi)
+		o.timeout = 0
+		if isNetworkFS {
+			o.timeout = s.networkFSTimeout
+		}
+		mounted = append(mounted, o)
 	}
 
 	// remove entries for mounts that no longer exist
 	for name, o := range s.FS {
-		if !o.IsMounted {
+		if !o.IsMounted() {
+			misc.UnregisterMetrics(o.Metrics, s.m, "fsstat."+name)
 			delete(s.FS, name)
 		}
 	}
+	s.mu.Unlock()
+
+	// statfs can block for up to networkFSTimeout per network
+	// mount, don't hold s.mu and stall the accessors meanwhile
+	for _, o := range mounted {
+		o.Collect()
+	}
+	s.RecordCollect(scanner.Err())
+}
+
+// SetFS makes Collect() read proc/self/mountinfo from fsys instead
+// of the real filesystem. The mount points found are still passed
+// to statfs(2) as they are
+func (s *FSStat) SetFS(fsys fs.FS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fs = fsys
+}
+
+// SetExclude stops tracking mounts whose source device or
+// filesystem type is listed, from the next Collect() on. They
+// default to DefaultExcludeDevices and DefaultExcludeFSTypes
+func (s *FSStat) SetExclude(devices, fstypes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.excludeDevices = append([]string(nil), devices...)
+	s.excludeFSTypes = append([]string(nil), fstypes...)
+}
+
+// SetExcludeMountGlobs stops tracking mount points matching one of
+// globs (path.Match patterns), or below a directory matching one,
+// from the next Collect() on, e.g. "/var/lib/docker/*" skips every
+// mount under /var/lib/docker/<dir>. Trailing slashes are ignored
+func (s *FSStat) SetExcludeMountGlobs(globs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.excludeMountGlobs = append([]string(nil), globs...)
+}
+
+// SetNetworkFS enables collection of network filesystems (see
+// NetworkFSTypes) from the next Collect() on. statfs for these
+// runs in a separate goroutine and is abandoned after timeout, so
+// one hung mount can't stall collection of the others. timeout
+// <= 0 uses DefaultNetworkFSTimeout
+func (s *FSStat) SetNetworkFS(include bool, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultNetworkFSTimeout
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.includeNetworkFS = include
+	s.networkFSTimeout = timeout
+}
+
+// ByUsage implements sort.Interface for []*PerFSStat based on
+// the Usage() method
+type ByUsage []*PerFSStat
+
+func (a ByUsage) Len() int           { return len(a) }
+func (a ByUsage) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByUsage) Less(i, j int) bool { return a[i].Usage() > a[j].Usage() }
+
+// ByUsage() returns a slice of *PerFSStat entries sorted
+// by block usage. The slice is a snapshot and is not updated
+// by Collect()
+func (s *FSStat) ByUsage() []*PerFSStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v := make([]*PerFSStat, 0)
+	for _, o := range s.FS {
+		if !math.IsNaN(o.Usage()) {
+			v = append(v, o)
+		}
+	}
+	sort.Sort(ByUsage(v))
+	return v
+}
+
+// ByFileUsage implements sort.Interface for []*PerFSStat based on
+// the FileUsage() method
+type ByFileUsage []*PerFSStat
+
+func (a ByFileUsage) Len() int           { return len(a) }
+func (a ByFileUsage) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByFileUsage) Less(i, j int) bool { return a[i].FileUsage() > a[j].FileUsage() }
+
+// ByFileUsage() returns a slice of *PerFSStat entries sorted
+// by file node usage
+func (s *FSStat) ByFileUsage() []*PerFSStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v := make([]*PerFSStat, 0)
+	for _, o := range s.FS {
+		if !math.IsNaN(o.FileUsage()) {
+			v = append(v, o)
+		}
+	}
+	sort.Sort(ByFileUsage(v))
+	return v
+}
+
+// ByDevice returns tracked mounts grouped by DeviceNumber(), with
+// mounts of a device sorted by mountpoint. Summing capacity over
+// the first mount of each device avoids counting a filesystem
+// mounted in several places more than once. The device number
+// rather than Device() identifies the filesystem, sources like
+// "tmpfs" or "overlay" are shared by unrelated mounts
+func (s *FSStat) ByDevice() map[string][]*PerFSStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r := make(map[string][]*PerFSStat)
+	for _, o := range s.FS {
+		d := o.DeviceNumber()
+		r[d] = append(r[d], o)
+	}
+	for _, v := range r {
+		sort.Slice(v, func(i, j int) bool { return v[i].mp < v[j].mp })
+	}
+	return r
+}
+
+// Get returns the tracked filesystem mounted at mp. mp is cleaned
+// and, if not found as is, symlinks in it are resolved, so
+// "/data/" or a symlink to /data find the mount at /data. Only
+// mountpoints match, see For() to find the filesystem holding an
+// arbitrary path
+func (s *FSStat) Get(mp string) (*PerFSStat, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	mp = filepath.Clean(mp)
+	if o, ok := s.FS[mp]; ok {
+		return o, true
+	}
+	if r, err := filepath.EvalSymlinks(mp); err == nil {
+		o, ok := s.FS[r]
+		return o, ok
+	}
+	return nil, false
+}
+
+// For returns the tracked filesystem containing p, i.e. the mount
+// with the longest mountpoint which is p or one of its parents
+// after cleaning p and resolving symlinks. With /, /var and
+// /var/lib/docker mounted, For("/var/lib/docker/x") returns
+// /var/lib/docker and For("/var/log") /var. p needn't exist, the
+// symlinks of its longest existing prefix are resolved, so a
+// file about to be created can be looked up. Returns false if the
+// filesystem holding p isn't tracked, e.g. it is excluded from
+// collection; the device numbers of p and the candidate mount are
+// compared so a parent mount isn't returned instead
+func (s *FSStat) For(p string) (*PerFSStat, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p = evalExistingSymlinks(filepath.Clean(p))
+	for dir := p; ; dir = filepath.Dir(dir) {
+		if o, ok := s.FS[dir]; ok {
+			if !sameDevice(p, dir) {
+				return nil, false
+			}
+			return o, true
+		}
+		if dir == "/" || dir == "." {
+			return nil, false
+		}
+	}
+}
+
+// evalExistingSymlinks resolves symlinks in the longest existing
+// prefix of the clean path p and appends the rest of p as is
+func evalExistingSymlinks(p string) string {
+	rest := ""
+	for dir := p; ; dir = filepath.Dir(dir) {
+		if r, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(r, rest)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return p
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// sameDevice returns false if a and b can be stat'ed and are on
+// different devices
+func sameDevice(a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return true
+	}
+	return sa.Dev == sb.Dev
+}
+
+// mountInfo holds the fields we care about from
+// a /proc/self/mountinfo line
+type mountInfo struct {
+	mountpoint string
+	fstype     string
+	device     string
+	devno      string // major:minor
+	readOnly   bool
+}
+
+// parseMountInfo parses a line of /proc/self/mountinfo
+// man 5 proc:
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+// (1)(2)(3)   (4)   (5)      (6)      (7)   (8) (9)   (10)         (11)
+// (7) is zero or more optional fields terminated by a single "-"
+// A mount is read-only if "ro" is set in either the per mount
+// options (6) or the per superblock options (11)
+func parseMountInfo(line string) (*mountInfo, bool) {
+	f := strings.Fields(line)
+	if len(f) < 10 {
+		return nil, false
+	}
+
+	sep := -1
+	for i := 6; i < len(f); i++ {
+		if f[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || sep+2 >= len(f) {
+		return nil, false
+	}
+
+	mi := new(mountInfo)
+	mi.devno = f[2]
+	mi.mountpoint = unescapeMount(f[4])
+	mi.fstype = f[sep+1]
+	mi.device = unescapeMount(f[sep+2])
+	mi.readOnly = contains(strings.Split(f[5], ","), "ro")
+	if sep+3 < len(f) && contains(strings.Split(f[sep+3], ","), "ro") {
+		mi.readOnly = true
+	}
+	return mi, true
+}
+
+// unescapeMount replaces octal escapes (\040 for space etc)
+// used by the kernel for whitespace and backslashes in paths
+func unescapeMount(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) &&
+			isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b = append(b, (s[i+1]-'0')<<6|(s[i+2]-'0')<<3|(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesGlob returns true if mp or one of its parent
+// directories matches any of globs. Malformed patterns
+// never match
+func matchesGlob(globs []string, mp string) bool {
+	if len(globs) == 0 {
+		return false
+	}
+	mp = trimSlash(mp)
+	for _, g := range globs {
+		g = trimSlash(g)
+		for p := mp; ; p = path.Dir(p) {
+			if ok, err := path.Match(g, p); err == nil && ok {
+				return true
+			}
+			if p == "/" || p == "." {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// trimSlash removes trailing slashes except from "/"
+func trimSlash(p string) string {
+	for len(p) > 1 && strings.HasSuffix(p, "/") {
+		p = p[:len(p)-1]
+	}
+	return p
+}
+
+// SampleUsage returns block usage of the filesystem mounted
+// at mp as percentage with a single statfs(2), without a
+// MetricContext. NaN if the filesystem reports no blocks
+func SampleUsage(mp string) (float64, error) {
+	buf := new(syscall.Statfs_t)
+	if err := syscall.Statfs(mp, buf); err != nil {
+		return math.NaN(), err
+	}
+	total := float64(buf.Blocks)
+	free := float64(buf.Bfree)
+	if total == 0 {
+		return math.NaN(), nil
+	}
+	return ((total - free) / total) * 100, nil
 }
 
 type PerFSStat struct {
-	Metrics   *PerFSStatMetrics
-	m         *metrics.MetricContext
-	mp        string
-	IsMounted bool
+	Metrics  *PerFSStatMetrics
+	m        *metrics.MetricContext
+	mp       string
+	mu       sync.RWMutex // guards fstype, device, devno, readOnly and mounted
+	fstype   string
+	device   string
+	devno    string
+	readOnly bool
+	mounted  bool
+	timeout  time.Duration // statfs timeout, 0 means call inline
+	pending  int32         // statfs in flight, see statfs()
 }
 
 // man statfs
@@ -96,6 +493,8 @@ type PerFSStatMetrics struct {
 	Bavail *metrics.Gauge
 	Files  *metrics.Gauge
 	Ffree  *metrics.Gauge
+	// 1 if mounted read-only, 0 otherwise
+	ReadOnly *metrics.Gauge
 }
 
 func NewPerFSStat(m *metrics.MetricContext, mp string) *PerFSStat {
@@ -106,11 +505,34 @@ func NewPerFSStat(m *metrics.MetricContext, mp string) *PerFSStat {
 	return c
 }
 
+// update records the mountinfo fields of a mount seen by
+// FSStat.Collect()
+func (s *PerFSStat) update(mi *mountInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mounted = true
+	s.fstype = mi.fstype
+	s.device = mi.device
+	s.devno = mi.devno
+	s.readOnly = mi.readOnly
+}
+
+func (s *PerFSStat) setMounted(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mounted = v
+}
+
 func (s *PerFSStat) Collect() {
 
+	if s.ReadOnly() {
+		s.Metrics.ReadOnly.Set(1)
+	} else {
+		s.Metrics.ReadOnly.Set(0)
+	}
+
 	// call statfs and populate metrics
-	buf := new(syscall.Statfs_t)
-	err := syscall.Statfs(s.mp, buf)
+	buf, err := s.statfs()
 	if err != nil {
 		return
 	}
@@ -123,18 +545,143 @@ func (s *PerFSStat) Collect() {
 	s.Metrics.Ffree.Set(float64(buf.Ffree))
 }
 
-// Filesystem block usage in percentage
+var errStatfsTimeout = errors.New("statfs timed out")
+
+// statfs calls statfs(2) for the mount point. If a timeout is set
+// the call is made from a separate goroutine and abandoned once the
+// timeout expires. No new call is started while an abandoned one
+// is still blocked
+func (s *PerFSStat) statfs() (*syscall.Statfs_t, error) {
+	buf := new(syscall.Statfs_t)
+	if s.timeout <= 0 {
+		err := syscall.Statfs(s.mp, buf)
+		return buf, err
+	}
+
+	if !atomic.CompareAndSwapInt32(&s.pending, 0, 1) {
+		return nil, errStatfsTimeout
+	}
+	c := make(chan error, 1)
+	go func() {
+		c <- syscall.Statfs(s.mp, buf)
+		atomic.StoreInt32(&s.pending, 0)
+	}()
+
+	select {
+	case err := <-c:
+		return buf, err
+	case <-time.After(s.timeout):
+		return nil, errStatfsTimeout
+	}
+}
+
+// Mountpoint returns where the filesystem is mounted
+func (s *PerFSStat) Mountpoint() string {
+	return s.mp
+}
+
+// Device returns the mount source from mountinfo, e.g. /dev/sda1.
+// Bind mounts and btrfs subvolumes share the device of the
+// filesystem they are taken from
+func (s *PerFSStat) Device() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.device
+}
+
+// DeviceNumber returns the major:minor number of the filesystem
+// from mountinfo, e.g. 8:1. Unlike Device() it is unique per
+// filesystem, bind mounts and btrfs subvolumes share it
+func (s *PerFSStat) DeviceNumber() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.devno
+}
+
+// FSType returns filesystem type of the mount e.g. ext4, tmpfs
+func (s *PerFSStat) FSType() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fstype
+}
+
+// ReadOnly returns true if the filesystem is mounted read-only,
+// e.g. after being remounted due to errors
+func (s *PerFSStat) ReadOnly() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readOnly
+}
+
+// IsMounted returns false once the filesystem has disappeared
+// from mountinfo; Collect() stops tracking it at that point
+func (s *PerFSStat) IsMounted() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mounted
+}
+
+// Filesystem block usage in percentage. NaN if the filesystem
+// reports no blocks (some pseudo or not yet ready mounts) or
+// hasn't been collected yet; callers should filter it out like
+// ByUsage() does
 func (s *PerFSStat) Usage() float64 {
 	o := s.Metrics
 	total := o.Blocks.Get()
 	free := o.Bfree.Get()
+	if !(total > 0) {
+		return math.NaN()
+	}
 	return ((total - free) / total) * 100
 }
 
-// Filesystem file node usage
+// Filesystem block usage as misc.ByteSize
+func (s *PerFSStat) UsageSize() misc.ByteSize {
+	return s.UsedBytes()
+}
+
+// TotalBytes returns size of the filesystem
+func (s *PerFSStat) TotalBytes() misc.ByteSize {
+	o := s.Metrics
+	return misc.ByteSize(o.Blocks.Get() * o.Bsize.Get())
+}
+
+// FreeBytes returns free space including blocks
+// reserved for root
+func (s *PerFSStat) FreeBytes() misc.ByteSize {
+	o := s.Metrics
+	return misc.ByteSize(o.Bfree.Get() * o.Bsize.Get())
+}
+
+// AvailBytes returns free space available to unprivileged
+// users. Unlike FreeBytes this excludes blocks reserved for
+// root, so it is the figure that matters for most writers
+func (s *PerFSStat) AvailBytes() misc.ByteSize {
+	o := s.Metrics
+	return misc.ByteSize(o.Bavail.Get() * o.Bsize.Get())
+}
+
+// UsedBytes returns space in use (total - free)
+func (s *PerFSStat) UsedBytes() misc.ByteSize {
+	return s.TotalBytes() - s.FreeBytes()
+}
+
+// Filesystem file node usage in percentage. NaN if the
+// filesystem doesn't track inodes, see HasInodes(), so a total
+// of 0 never divides
 func (s *PerFSStat) FileUsage() float64 {
+	if !s.HasInodes() {
+		return math.NaN()
+	}
 	o := s.Metrics
 	total := o.Files.Get()
 	free := o.Ffree.Get()
 	return ((total - free) / total) * 100
 }
+
+// HasInodes returns true if the filesystem reports a total
+// number of file nodes. Some (e.g. btrfs, overlay, some tmpfs
+// setups) report 0, so inode usage alerts don't apply to them
+func (s *PerFSStat) HasInodes() bool {
+	return s.Metrics.Files.Get() > 0
+}
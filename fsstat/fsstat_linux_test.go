@@ -0,0 +1,537 @@
+// Copyright (c) 2014 Square, Inc
+
+package fsstat
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		want mountInfo
+	}{
+		{
+			line: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue",
+			ok:   true,
+			want: mountInfo{mountpoint: "/mnt2", fstype: "ext3", device: "/dev/root", devno: "98:0"},
+		},
+		{
+			// no optional fields
+			line: "22 1 8:1 / / rw,relatime - xfs /dev/sda1 rw,attr2",
+			ok:   true,
+			want: mountInfo{mountpoint: "/", fstype: "xfs", device: "/dev/sda1", devno: "8:1"},
+		},
+		{
+			// several optional fields
+			line: "40 22 0:35 / /sys/fs/cgroup rw shared:9 master:2 - cgroup2 cgroup2 rw",
+			ok:   true,
+			want: mountInfo{mountpoint: "/sys/fs/cgroup", fstype: "cgroup2", device: "cgroup2", devno: "0:35"},
+		},
+		{
+			// read-only per mount
+			line: "50 22 8:2 / /boot ro,relatime - ext4 /dev/sda2 rw",
+			ok:   true,
+			want: mountInfo{mountpoint: "/boot", fstype: "ext4", device: "/dev/sda2", devno: "8:2", readOnly: true},
+		},
+		{
+			// read-only per superblock
+			line: "51 22 8:3 / /data rw,relatime - ext4 /dev/sda3 ro,errors=remount-ro",
+			ok:   true,
+			want: mountInfo{mountpoint: "/data", fstype: "ext4", device: "/dev/sda3", devno: "8:3", readOnly: true},
+		},
+		{
+			// spaces in mount point and device are escaped
+			line: `60 22 0:40 / /mnt/my\040disk rw - fuse.sshfs user@host:/my\040dir rw`,
+			ok:   true,
+			want: mountInfo{mountpoint: "/mnt/my disk", fstype: "fuse.sshfs", device: "user@host:/my dir", devno: "0:40"},
+		},
+		{
+			// no separator
+			line: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 ext3 /dev/root rw",
+		},
+		{
+			// nothing after the separator
+			line: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 shared:2 -",
+		},
+		{line: ""},
+	}
+	for _, tt := range tests {
+		mi, ok := parseMountInfo(tt.line)
+		if ok != tt.ok {
+			t.Errorf("parseMountInfo(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if ok && *mi != tt.want {
+			t.Errorf("parseMountInfo(%q) = %+v, want %+v", tt.line, *mi, tt.want)
+		}
+	}
+}
+
+func TestUnescapeMount(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"/mnt/plain", "/mnt/plain"},
+		{`/mnt/a\040b`, "/mnt/a b"},
+		{`/mnt/tab\011x`, "/mnt/tab\tx"},
+		{`/mnt/nl\012`, "/mnt/nl\n"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`\040\040`, "  "},
+		// not a complete octal escape, left alone
+		{`/mnt/a\04`, `/mnt/a\04`},
+		{`/mnt/a\089`, `/mnt/a\089`},
+		{`/mnt/a\`, `/mnt/a\`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMount(tt.in); got != tt.want {
+			t.Errorf("unescapeMount(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesGlob(t *testing.T) {
+	tests := []struct {
+		globs []string
+		mp    string
+		want  bool
+	}{
+		{nil, "/var/lib/docker/overlay2/abc/merged", false},
+		{[]string{"/var/lib/docker/*"}, "/var/lib/docker/overlay2", true},
+		// parents are matched too, excluding everything below
+		{[]string{"/var/lib/docker/*"}, "/var/lib/docker/overlay2/abc/merged", true},
+		{[]string{"/var/lib/docker/*"}, "/var/lib/docker", false},
+		{[]string{"/var/lib/docker/*"}, "/var/lib/dockerd/x", false},
+		{[]string{"/run/user/*"}, "/run", false},
+		{[]string{"/snap/*/*"}, "/snap/core/1234", true},
+		{[]string{"/mnt/disk?"}, "/mnt/disk1", true},
+		{[]string{"/mnt/disk?"}, "/mnt/disk10", false},
+		// trailing slashes are ignored
+		{[]string{"/srv/*/"}, "/srv/data/", true},
+		{[]string{"/"}, "/", true},
+		{[]string{"/tmp", "/home/*"}, "/home/alice", true},
+		// a malformed pattern never matches
+		{[]string{"/mnt/["}, "/mnt/[", false},
+	}
+	for _, tt := range tests {
+		if got := matchesGlob(tt.globs, tt.mp); got != tt.want {
+			t.Errorf("matchesGlob(%q, %q) = %v, want %v", tt.globs, tt.mp, got, tt.want)
+		}
+	}
+}
+
+func TestCollectUnmount(t *testing.T) {
+	dir := t.TempDir()
+	root := "22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n"
+	data := "23 22 8:2 / " + dir + " rw,relatime - ext4 /dev/sdb1 rw\n"
+	proc := "24 22 0:4 / /proc rw - proc proc rw\n"
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte(root + data + proc)},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := metrics.NewMetricContext("test")
+	s := NewWithContext(ctx, m, time.Hour)
+	s.SetFS(fsys)
+
+	s.Collect()
+	if err := s.LastError(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("/proc"); ok {
+		t.Errorf("excluded /proc tracked")
+	}
+	o, ok := s.Get(dir)
+	if !ok {
+		t.Fatalf("%s not tracked", dir)
+	}
+	if o.Device() != "/dev/sdb1" {
+		t.Errorf("Device() = %q, want /dev/sdb1", o.Device())
+	}
+	if o.Metrics.Blocks.Get() <= 0 {
+		t.Errorf("Blocks = %v, statfs not called", o.Metrics.Blocks.Get())
+	}
+	if _, ok := m.Gauges["fsstat."+dir+".Bsize"]; !ok {
+		t.Errorf("fsstat.%s.Bsize not registered", dir)
+	}
+
+	// dir is unmounted
+	fsys["proc/self/mountinfo"] = &fstest.MapFile{Data: []byte(root + proc)}
+	s.Collect()
+	if _, ok := s.Get(dir); ok {
+		t.Errorf("%s still tracked after it was unmounted", dir)
+	}
+	if o.IsMounted() {
+		t.Errorf("IsMounted() = true after %s was unmounted", dir)
+	}
+	if _, ok := s.Get("/"); !ok {
+		t.Errorf("/ not tracked anymore")
+	}
+	for name := range m.Gauges {
+		if strings.HasPrefix(name, "fsstat."+dir+".") {
+			t.Errorf("%s still registered after unmount", name)
+		}
+	}
+}
+
+func TestConcurrentAccessors(t *testing.T) {
+	dir := t.TempDir()
+	rw := "23 22 8:2 / " + dir + " rw,relatime - ext4 /dev/sdb1 rw\n"
+	ro := "23 22 8:2 / " + dir + " ro,relatime - ext4 /dev/sdb1 ro\n"
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte(rw)},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewWithContext(ctx, metrics.NewMetricContext("test"), time.Hour)
+	s.SetFS(fsys)
+	s.Collect()
+	o, ok := s.Get(dir)
+	if !ok {
+		t.Fatalf("%s not tracked", dir)
+	}
+
+	// remounted read-only and back while being read, run
+	// with -race
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = o.Device() + o.FSType()
+			_ = o.ReadOnly() && o.IsMounted()
+			_ = s.ByDevice()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		data := rw
+		if i%2 == 0 {
+			data = ro
+		}
+		s.SetFS(fstest.MapFS{
+			"proc/self/mountinfo": {Data: []byte(data)},
+		})
+		s.Collect()
+	}
+	wg.Wait()
+	if o.ReadOnly() {
+		t.Errorf("ReadOnly() = true after remounting read-write")
+	}
+}
+
+func TestCollectSetExclude(t *testing.T) {
+	dir := t.TempDir()
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte("23 22 8:2 / " + dir + " rw - ext4 /dev/sdb1 rw\n" +
+			"24 22 0:4 / /proc rw - proc proc rw\n")},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewWithContext(ctx, metrics.NewMetricContext("test"), time.Hour)
+	s.SetFS(fsys)
+
+	s.SetExclude(nil, []string{"ext4"})
+	s.Collect()
+	if _, ok := s.Get(dir); ok {
+		t.Errorf("%s tracked although ext4 is excluded", dir)
+	}
+	if _, ok := s.Get("/proc"); !ok {
+		t.Errorf("/proc not tracked although the device list is empty")
+	}
+
+	s.SetExclude([]string{"/dev/sdb1"}, nil)
+	s.Collect()
+	if _, ok := s.Get(dir); ok {
+		t.Errorf("%s tracked although /dev/sdb1 is excluded", dir)
+	}
+}
+
+func TestCollectSetNetworkFS(t *testing.T) {
+	dir := t.TempDir()
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte("23 22 0:50 / " + dir + " rw - nfs4 server:/export rw\n")},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewWithContext(ctx, metrics.NewMetricContext("test"), time.Hour)
+	s.SetFS(fsys)
+
+	s.Collect()
+	if _, ok := s.Get(dir); ok {
+		t.Fatalf("network filesystem %s tracked by default", dir)
+	}
+
+	s.SetNetworkFS(true, time.Second)
+	s.Collect()
+	o, ok := s.Get(dir)
+	if !ok {
+		t.Fatalf("network filesystem %s not tracked after SetNetworkFS", dir)
+	}
+	if o.timeout != time.Second {
+		t.Errorf("statfs timeout = %v, want 1s", o.timeout)
+	}
+	if o.Metrics.Blocks.Get() <= 0 {
+		t.Errorf("Blocks = %v, statfs not called", o.Metrics.Blocks.Get())
+	}
+
+	s.SetNetworkFS(true, 0)
+	s.Collect()
+	if o.timeout != DefaultNetworkFSTimeout {
+		t.Errorf("statfs timeout = %v, want DefaultNetworkFSTimeout", o.timeout)
+	}
+}
+
+func TestCollectSetExcludeMountGlobs(t *testing.T) {
+	dir := t.TempDir()
+	sub := dir + "/overlay2/abc/merged"
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte("23 22 8:2 / " + dir + " rw - ext4 /dev/sdb1 rw\n" +
+			"25 23 0:60 / " + sub + " rw - overlay overlay rw\n")},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewWithContext(ctx, metrics.NewMetricContext("test"), time.Hour)
+	s.SetFS(fsys)
+
+	s.SetExcludeMountGlobs([]string{dir + "/*"})
+	s.Collect()
+	if _, ok := s.Get(dir); !ok {
+		t.Errorf("%s not tracked", dir)
+	}
+	if _, ok := s.FS[sub]; ok {
+		t.Errorf("%s tracked although below an excluded glob", sub)
+	}
+}
+
+func TestByDeviceSameDevice(t *testing.T) {
+	a, b, c := t.TempDir(), t.TempDir(), t.TempDir()
+	// a and b are the same filesystem (b a bind mount of a),
+	// c is an unrelated tmpfs with the same source
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte("30 22 0:45 / " + a + " rw - tmpfs tmpfs rw\n" +
+			"31 22 0:45 /sub " + b + " rw - tmpfs tmpfs rw\n" +
+			"32 22 0:46 / " + c + " rw - tmpfs tmpfs rw\n")},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewWithContext(ctx, metrics.NewMetricContext("test"), time.Hour)
+	s.SetFS(fsys)
+	s.Collect()
+
+	r := s.ByDevice()
+	if len(r) != 2 {
+		t.Fatalf("ByDevice() has %d devices, want 2: %v", len(r), r)
+	}
+	same := r["0:45"]
+	if len(same) != 2 {
+		t.Fatalf("ByDevice()[0:45] has %d mounts, want 2", len(same))
+	}
+	want := []string{a, b}
+	if b < a {
+		want = []string{b, a}
+	}
+	for i, o := range same {
+		if o.Mountpoint() != want[i] {
+			t.Errorf("ByDevice()[0:45][%d] = %s, want %s", i, o.Mountpoint(), want[i])
+		}
+	}
+	if o := r["0:46"]; len(o) != 1 || o[0].Mountpoint() != c {
+		t.Errorf("ByDevice()[0:46] = %v, want only %s", o, c)
+	}
+}
+
+func TestCollectFSType(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte("23 22 8:2 / " + a + " rw - xfs /dev/sdb1 rw\n" +
+			"24 22 0:45 / " + b + " ro - tmpfs tmpfs rw\n")},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewWithContext(ctx, metrics.NewMetricContext("test"), time.Hour)
+	s.SetFS(fsys)
+	s.Collect()
+
+	tests := []struct {
+		mp, fstype string
+		readOnly   bool
+	}{
+		{a, "xfs", false},
+		{b, "tmpfs", true},
+	}
+	for _, tt := range tests {
+		o, ok := s.Get(tt.mp)
+		if !ok {
+			t.Fatalf("%s not tracked", tt.mp)
+		}
+		if o.FSType() != tt.fstype {
+			t.Errorf("%s: FSType() = %q, want %q", tt.mp, o.FSType(), tt.fstype)
+		}
+		if o.ReadOnly() != tt.readOnly {
+			t.Errorf("%s: ReadOnly() = %v, want %v", tt.mp, o.ReadOnly(), tt.readOnly)
+		}
+	}
+
+	// another filesystem mounted at a
+	fsys["proc/self/mountinfo"] = &fstest.MapFile{Data: []byte("25 22 8:3 / " + a + " rw - ext4 /dev/sdc1 rw\n")}
+	s.Collect()
+	o, ok := s.Get(a)
+	if !ok {
+		t.Fatalf("%s not tracked", a)
+	}
+	if o.FSType() != "ext4" || o.Device() != "/dev/sdc1" {
+		t.Errorf("FSType(), Device() = %q, %q after remount, want ext4, /dev/sdc1", o.FSType(), o.Device())
+	}
+}
+
+func TestFileUsageNoInodes(t *testing.T) {
+	m := metrics.NewMetricContext("test")
+	// btrfs and some FUSE filesystems report no inodes
+	btrfs, ext4 := NewPerFSStat(m, "/btrfs"), NewPerFSStat(m, "/ext4")
+	btrfs.Metrics.Files.Set(0)
+	btrfs.Metrics.Ffree.Set(0)
+	ext4.Metrics.Files.Set(100)
+	ext4.Metrics.Ffree.Set(25)
+
+	if btrfs.HasInodes() {
+		t.Errorf("HasInodes() = true with 0 inodes")
+	}
+	if v := btrfs.FileUsage(); !math.IsNaN(v) {
+		t.Errorf("FileUsage() = %v with 0 inodes, want NaN", v)
+	}
+	if !ext4.HasInodes() {
+		t.Errorf("HasInodes() = false with 100 inodes")
+	}
+	if v := ext4.FileUsage(); v != 75 {
+		t.Errorf("FileUsage() = %v, want 75", v)
+	}
+
+	s := &FSStat{FS: map[string]*PerFSStat{"/btrfs": btrfs, "/ext4": ext4}}
+	if v := s.ByFileUsage(); len(v) != 1 || v[0] != ext4 {
+		t.Errorf("ByFileUsage() = %v, want only /ext4", v)
+	}
+}
+
+func TestGetForNormalization(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(root, "a"), filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(a, link); err != nil {
+		t.Fatal(err)
+	}
+	// nested mounts, all on the same device as far as stat(2)
+	// is concerned
+	fsys := fstest.MapFS{
+		"proc/self/mountinfo": {Data: []byte("23 22 8:2 / " + root + " rw - ext4 /dev/sdb1 rw\n" +
+			"24 23 8:3 / " + a + " rw - ext4 /dev/sdb2 rw\n" +
+			"25 24 8:4 / " + b + " rw - ext4 /dev/sdb3 rw\n")},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewWithContext(ctx, metrics.NewMetricContext("test"), time.Hour)
+	s.SetFS(fsys)
+	s.Collect()
+
+	gets := []struct {
+		mp, want string
+	}{
+		{root + "/", root},
+		{a + "/", a},
+		{a + "/../a", a},
+		{b + "/./", b},
+		{root + "//a/b", b},
+		{link, a},
+		{link + "/", a},
+		// not mountpoints
+		{a + "/c", ""},
+		{root + "/..", ""},
+	}
+	for _, tt := range gets {
+		o, ok := s.Get(tt.mp)
+		if ok != (tt.want != "") {
+			t.Errorf("Get(%q) ok = %v, want %v", tt.mp, ok, tt.want != "")
+			continue
+		}
+		if ok && o.Mountpoint() != tt.want {
+			t.Errorf("Get(%q) = %s, want %s", tt.mp, o.Mountpoint(), tt.want)
+		}
+	}
+
+	fors := []struct {
+		p, want string
+	}{
+		// the deepest mount containing p wins
+		{root, root},
+		{root + "/x/y", root},
+		{a, a},
+		{a + "/c/d", a},
+		{b + "/x", b},
+		{b + "/..", a},
+		{a + "/../x", root},
+		{link + "/b/x", b},
+		{link + "/c", a},
+		// above every tracked mount
+		{filepath.Dir(root), ""},
+	}
+	for _, tt := range fors {
+		o, ok := s.For(tt.p)
+		if ok != (tt.want != "") {
+			t.Errorf("For(%q) ok = %v, want %v", tt.p, ok, tt.want != "")
+			continue
+		}
+		if ok && o.Mountpoint() != tt.want {
+			t.Errorf("For(%q) = %s, want %s", tt.p, o.Mountpoint(), tt.want)
+		}
+	}
+}
+
+func TestUsageNoBlocks(t *testing.T) {
+	m := metrics.NewMetricContext("test")
+	// pseudo filesystems and mounts not collected yet
+	empty, data := NewPerFSStat(m, "/empty"), NewPerFSStat(m, "/data")
+	empty.Metrics.Bsize.Set(4096)
+	empty.Metrics.Blocks.Set(0)
+	empty.Metrics.Bfree.Set(0)
+	data.Metrics.Bsize.Set(4096)
+	data.Metrics.Blocks.Set(1000)
+	data.Metrics.Bfree.Set(400)
+
+	for _, o := range []*PerFSStat{empty, NewPerFSStat(m, "/new")} {
+		if v := o.Usage(); !math.IsNaN(v) {
+			t.Errorf("%s: Usage() = %v without blocks, want NaN", o.Mountpoint(), v)
+		}
+		if v := o.FileUsage(); !math.IsNaN(v) {
+			t.Errorf("%s: FileUsage() = %v without inodes, want NaN", o.Mountpoint(), v)
+		}
+	}
+	if v := empty.UsedBytes(); v != 0 {
+		t.Errorf("UsedBytes() = %v without blocks, want 0", float64(v))
+	}
+	if v := data.Usage(); v != 60 {
+		t.Errorf("Usage() = %v, want 60", v)
+	}
+
+	s := &FSStat{FS: map[string]*PerFSStat{"/empty": empty, "/data": data}}
+	if v := s.ByUsage(); len(v) != 1 || v[0] != data {
+		t.Errorf("ByUsage() = %v, want only /data", v)
+	}
+}
@@ -4,28 +4,55 @@ package interfacestat
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/measure/os/misc"
 	"github.com/measure/metrics"
+	"math"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ARPHRD_LOOPBACK from linux/if_arp.h, as found in
+// /sys/class/net/<dev>/type
+const arphrdLoopback = 772
+
+// InterfaceStat tracks network interfaces. Interfaces is updated
+// by Collect(); use the accessor methods rather than reading it
+// directly from another goroutine
 type InterfaceStat struct {
-	Interfaces map[string]*PerInterfaceStat
-	m          *metrics.MetricContext
+	Interfaces      map[string]*PerInterfaceStat
+	includeLoopback bool // see SetIncludeLoopback()
+	m               *metrics.MetricContext
+	mu              sync.RWMutex
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *InterfaceStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
 }
 
-func New(m *metrics.MetricContext, Step time.Duration) *InterfaceStat {
+// NewWithContext returns an instance of InterfaceStat which stops
+// collecting metrics once ctx is done
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *InterfaceStat {
 	s := new(InterfaceStat)
 	s.Interfaces = make(map[string]*PerInterfaceStat, 4)
 	s.m = m
 
-	ticker := time.NewTicker(Step)
+	ticker := s.StartTicker(Step, misc.NewOptions(opts...).Jitter)
 	go func() {
-		for _ = range ticker.C {
-			s.Collect()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Collect()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -38,9 +65,13 @@ func (s *InterfaceStat) Collect() {
 	file, err := os.Open("/proc/net/dev")
 	defer file.Close()
 	if err != nil {
+		s.RecordCollect(err)
 		return
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var rx [8]uint64
 	var tx [8]uint64
 
@@ -60,10 +91,19 @@ func (s *InterfaceStat) Collect() {
 
 		o, ok := s.Interfaces[dev]
 		if !ok {
+			if !s.includeLoopback && isLoopback(dev) {
+				continue
+			}
 			o = NewPerInterfaceStat(s.m, dev)
+			o.owner = &s.mu
 			s.Interfaces[dev] = o
 		}
 
+		for i := range rx {
+			rx[i] = o.rxWrap[i].Update(rx[i])
+			tx[i] = o.txWrap[i].Update(tx[i])
+		}
+
 		d := o.Metrics
 		d.RXbytes.Set(rx[0])
 		d.RXpackets.Set(rx[1])
@@ -85,15 +125,94 @@ func (s *InterfaceStat) Collect() {
 		if speed > 0 {
 			d.Speed.Set(float64(speed))
 		}
+		o.collected = misc.Now()
+	}
+	s.RecordCollect(scanner.Err())
+}
+
+// SetIncludeLoopback makes Collect() track loopback interfaces,
+// skipped by default, from the next Collect() on. Loopback
+// interfaces already tracked keep being collected
+func (s *InterfaceStat) SetIncludeLoopback(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.includeLoopback = v
+}
+
+func isLoopback(dev string) bool {
+	t, err := misc.ReadUintFromFileErr("/sys/class/net/" + dev + "/type")
+	if err != nil {
+		return dev == "lo"
+	}
+	return t == arphrdLoopback
+}
+
+type ByTXUsage []*PerInterfaceStat
+
+func (a ByTXUsage) Len() int           { return len(a) }
+func (a ByTXUsage) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByTXUsage) Less(i, j int) bool { return a[i].TXBandwidth() > a[j].TXBandwidth() }
+
+// ByTXUsage returns a slice of *PerInterfaceStat entries sorted
+// by transmit bandwidth, interfaces without two samples yet are
+// left out
+func (s *InterfaceStat) ByTXUsage() []*PerInterfaceStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v := make([]*PerInterfaceStat, 0, len(s.Interfaces))
+	for _, o := range s.Interfaces {
+		if !math.IsNaN(o.TXBandwidth()) {
+			v = append(v, o)
+		}
 	}
+	sort.Sort(ByTXUsage(v))
+	return v
+}
+
+type ByErrorRate []*PerInterfaceStat
+
+func (a ByErrorRate) Len() int           { return len(a) }
+func (a ByErrorRate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByErrorRate) Less(i, j int) bool { return a[i].ErrorRate() > a[j].ErrorRate() }
+
+// ByErrorRate returns a slice of *PerInterfaceStat entries sorted
+// by receive plus transmit errors per second, interfaces without
+// two samples yet are left out
+func (s *InterfaceStat) ByErrorRate() []*PerInterfaceStat {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v := make([]*PerInterfaceStat, 0, len(s.Interfaces))
+	for _, o := range s.Interfaces {
+		if !math.IsNaN(o.ErrorRate()) {
+			v = append(v, o)
+		}
+	}
+	sort.Sort(ByErrorRate(v))
+	return v
 }
 
 type PerInterfaceStat struct {
-	Metrics *PerInterfaceStatMetrics
-	m       *metrics.MetricContext
+	Metrics   *PerInterfaceStatMetrics
+	m         *metrics.MetricContext
+	collected time.Time     // last Collect() which saw the interface
+	owner     *sync.RWMutex // InterfaceStat.mu, nil if standalone
+	// /proc/net/dev columns are unsigned long and wrap at 32
+	// bits on 32 bit kernels
+	rxWrap [8]misc.WrapCounter
+	txWrap [8]misc.WrapCounter
 }
 
-// bytes    packets errs drop fifo frame compressed multicast
+// Counters are filled in order from the fixed columns of
+// /proc/net/dev following "<dev>:"
+//
+//	receive:  bytes packets errs drop fifo frame compressed multicast
+//	transmit: bytes packets errs drop fifo colls carrier compressed
+//
+// so RXerrs/RXdrop are columns 3/4 and TXerrs/TXdrop columns 11/12.
+// The transmit colls, carrier and compressed columns end up in
+// TXframe, TXcompressed and TXmulticast respectively
 type PerInterfaceStatMetrics struct {
 	RXbytes      *metrics.Counter
 	RXpackets    *metrics.Counter
@@ -128,6 +247,16 @@ func (s *PerInterfaceStat) RXBandwidth() float64 {
 	return (o.RXbytes.ComputeRate()) * 8
 }
 
+// RXBytesRate returns bytes received per second
+func (s *PerInterfaceStat) RXBytesRate() float64 {
+	return s.Metrics.RXbytes.ComputeRate()
+}
+
+// TXBytesRate returns bytes transmitted per second
+func (s *PerInterfaceStat) TXBytesRate() float64 {
+	return s.Metrics.TXbytes.ComputeRate()
+}
+
 // Transmit bandwidth utilization in bits/sec
 func (s *PerInterfaceStat) TXBandwidth() float64 {
 	o := s.Metrics
@@ -149,3 +278,67 @@ func (s *PerInterfaceStat) RXBandwidthUsage() float64 {
 func (s *PerInterfaceStat) TXBandwidthUsage() float64 {
 	return (s.TXBandwidth() / s.Speed()) * 100
 }
+
+// RXErrorRate returns receive errors per second (RXerrs)
+func (s *PerInterfaceStat) RXErrorRate() float64 {
+	return s.Metrics.RXerrs.ComputeRate()
+}
+
+// TXErrorRate returns transmit errors per second (TXerrs)
+func (s *PerInterfaceStat) TXErrorRate() float64 {
+	return s.Metrics.TXerrs.ComputeRate()
+}
+
+// RXDropRate returns received packets dropped per second (RXdrop)
+func (s *PerInterfaceStat) RXDropRate() float64 {
+	return s.Metrics.RXdrop.ComputeRate()
+}
+
+// TXDropRate returns transmit packets dropped per second (TXdrop)
+func (s *PerInterfaceStat) TXDropRate() float64 {
+	return s.Metrics.TXdrop.ComputeRate()
+}
+
+// ErrorRate returns receive plus transmit errors per second
+func (s *PerInterfaceStat) ErrorRate() float64 {
+	return s.RXErrorRate() + s.TXErrorRate()
+}
+
+// InterfaceSample holds the raw cumulative counters of an interface
+// as of the last Collect(), see PerInterfaceStat.Sample(). Time is
+// when Collect() read them
+type InterfaceSample struct {
+	Time      time.Time
+	RXbytes   uint64
+	RXpackets uint64
+	RXerrs    uint64
+	RXdrop    uint64
+	TXbytes   uint64
+	TXpackets uint64
+	TXerrs    uint64
+	TXdrop    uint64
+}
+
+// Sample captures the current counters. The difference of two
+// samples over their Time delta gives rates over any window,
+// unlike the ComputeRate() based methods which only cover the
+// last two Collect() calls. All counters come from the same
+// Collect(), it is safe to call concurrently with it
+func (s *PerInterfaceStat) Sample() InterfaceSample {
+	if s.owner != nil {
+		s.owner.RLock()
+		defer s.owner.RUnlock()
+	}
+	o := s.Metrics
+	return InterfaceSample{
+		Time:      s.collected,
+		RXbytes:   o.RXbytes.Get(),
+		RXpackets: o.RXpackets.Get(),
+		RXerrs:    o.RXerrs.Get(),
+		RXdrop:    o.RXdrop.Get(),
+		TXbytes:   o.TXbytes.Get(),
+		TXpackets: o.TXpackets.Get(),
+		TXerrs:    o.TXerrs.Get(),
+		TXdrop:    o.TXdrop.Get(),
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014 Square, Inc
+
+package loadstat
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/misc"
+)
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+// LoadStat encapsulates system load average
+// RunnableProcs and TotalProcs are not available on darwin
+type LoadStat struct {
+	Load1         *metrics.Gauge
+	Load5         *metrics.Gauge
+	Load15        *metrics.Gauge
+	RunnableProcs *metrics.Gauge
+	TotalProcs    *metrics.Gauge
+	m             *metrics.MetricContext
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+// New returns an instance of LoadStat
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *LoadStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewWithContext returns an instance of LoadStat which stops
+// collecting metrics once ctx is done
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *LoadStat {
+	s := new(LoadStat)
+	s.m = m
+	// initialize all metrics and register them
+	misc.InitializeMetrics(s, m, "loadstat", true)
+
+	ticker := s.StartTicker(Step, misc.NewOptions(opts...).Jitter)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Collect()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Collect calls getloadavg(3)
+func (s *LoadStat) Collect() {
+	l1, l5, l15, err := SampleLoad()
+	if err != nil {
+		s.RecordCollect(err)
+		return
+	}
+
+	s.Load1.Set(l1)
+	s.Load5.Set(l5)
+	s.Load15.Set(l15)
+	s.RecordCollect(nil)
+}
+
+// SampleLoad returns the 1, 5 and 15 minute load averages
+// without a MetricContext, e.g. for short-lived tools
+func SampleLoad() (load1, load5, load15 float64, err error) {
+	var loadavg [3]C.double
+
+	if C.getloadavg(&loadavg[0], 3) != 3 {
+		return 0, 0, 0, errors.New("getloadavg failed")
+	}
+	return float64(loadavg[0]), float64(loadavg[1]), float64(loadavg[2]), nil
+}
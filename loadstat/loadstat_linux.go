@@ -0,0 +1,101 @@
+// Copyright (c) 2014 Square, Inc
+
+package loadstat
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/misc"
+)
+
+// LoadStat encapsulates system load average
+type LoadStat struct {
+	Load1         *metrics.Gauge
+	Load5         *metrics.Gauge
+	Load15        *metrics.Gauge
+	RunnableProcs *metrics.Gauge // currently runnable scheduling entities
+	TotalProcs    *metrics.Gauge // scheduling entities that exist
+	m             *metrics.MetricContext
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+// New returns an instance of LoadStat
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *LoadStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewWithContext returns an instance of LoadStat which stops
+// collecting metrics once ctx is done
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *LoadStat {
+	s := new(LoadStat)
+	s.m = m
+	// initialize all metrics and register them
+	misc.InitializeMetrics(s, m, "loadstat", true)
+
+	ticker := s.StartTicker(Step, misc.NewOptions(opts...).Jitter)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Collect()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Collect reads /proc/loadavg
+// e.g. "0.20 0.18 0.12 1/80 11206"
+func (s *LoadStat) Collect() {
+	l, err := readLoadavg()
+	if err != nil {
+		s.RecordCollect(err)
+		return
+	}
+
+	s.Load1.Set(l.load[0])
+	s.Load5.Set(l.load[1])
+	s.Load15.Set(l.load[2])
+	s.RunnableProcs.Set(float64(l.runnable))
+	s.TotalProcs.Set(float64(l.total))
+	s.RecordCollect(nil)
+}
+
+// SampleLoad returns the 1, 5 and 15 minute load averages
+// without a MetricContext, e.g. for short-lived tools
+func SampleLoad() (load1, load5, load15 float64, err error) {
+	l, err := readLoadavg()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return l.load[0], l.load[1], l.load[2], nil
+}
+
+type loadavg struct {
+	load     [3]float64
+	runnable uint64
+	total    uint64
+}
+
+func readLoadavg() (*loadavg, error) {
+	line, err := misc.ReadStringFromFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(loadavg)
+	_, err = fmt.Sscanf(line, "%f %f %f %d/%d", &l.load[0], &l.load[1],
+		&l.load[2], &l.runnable, &l.total)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
@@ -4,6 +4,7 @@ package memstat
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"math"
 	"os"
@@ -21,23 +22,42 @@ type CgroupStat struct {
 	Cgroups    map[string]*PerCgroupStat
 	m          *metrics.MetricContext
 	Mountpoint string
+	opts       misc.Options
+	misc.CollectStatus
+	misc.StepTicker
 }
 
-func NewCgroupStat(m *metrics.MetricContext, Step time.Duration) *CgroupStat {
+func NewCgroupStat(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CgroupStat {
+	return NewCgroupStatWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewCgroupStatWithContext returns an instance of CgroupStat
+// which stops collecting metrics once ctx is done
+// If the memory subsystem isn't mounted nothing is collected and
+// LastError() matches misc.ErrCgroupNotMounted with errors.Is
+func NewCgroupStatWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *CgroupStat {
 	c := new(CgroupStat)
 	c.m = m
+	c.opts = misc.NewOptions(opts...)
 	c.Cgroups = make(map[string]*PerCgroupStat, 1)
 
 	mountpoint, err := misc.FindCgroupMount("memory")
 	if err != nil {
+		c.RecordCollect(err)
 		return c
 	}
 	c.Mountpoint = mountpoint
 
-	ticker := time.NewTicker(Step)
+	ticker := c.StartTicker(Step, c.opts.Jitter)
 	go func() {
-		for _ = range ticker.C {
-			c.Collect(mountpoint)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Collect(mountpoint)
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -48,9 +68,20 @@ func (c *CgroupStat) Collect(mountpoint string) {
 
 	cgroups, err := misc.FindCgroups(mountpoint)
 	if err != nil {
+		c.RecordCollect(err)
 		return
 	}
 
+	if c.opts.CgroupFilter != nil {
+		filtered := cgroups[:0]
+		for _, cgroup := range cgroups {
+			if c.opts.CgroupFilter(cgroup) {
+				filtered = append(filtered, cgroup)
+			}
+		}
+		cgroups = filtered
+	}
+
 	// stop tracking cgroups which don't exist
 	// anymore or have no tasks
 	cgroupsMap := make(map[string]bool, len(cgroups))
@@ -58,9 +89,11 @@ func (c *CgroupStat) Collect(mountpoint string) {
 		cgroupsMap[cgroup] = true
 	}
 
-	for cgroup, _ := range c.Cgroups {
+	for cgroup, s := range c.Cgroups {
 		_, ok := cgroupsMap[cgroup]
 		if !ok {
+			prefix, _ := filepath.Rel(mountpoint, cgroup)
+			misc.UnregisterMetrics(s, c.m, "memstat.cgroup."+prefix)
 			delete(c.Cgroups, cgroup)
 		}
 	}
@@ -72,6 +105,7 @@ func (c *CgroupStat) Collect(mountpoint string) {
 		}
 		c.Cgroups[cgroup].Collect()
 	}
+	c.RecordCollect(nil)
 
 }
 
@@ -105,6 +139,10 @@ type PerCgroupStat struct {
 	Total_unevictable         *metrics.Gauge
 	// memory.soft_limit_in_bytes
 	Soft_Limit_In_Bytes *metrics.Gauge
+	// memory.usage_in_bytes
+	Usage_In_Bytes *metrics.Gauge
+	// memory.limit_in_bytes
+	Limit_In_Bytes *metrics.Gauge
 	// Approximate usage in bytes
 	UsageInBytes *metrics.Gauge
 	path         string
@@ -139,6 +177,23 @@ func (s *PerCgroupStat) SoftLimit() float64 {
 	return s.Soft_Limit_In_Bytes.Get()
 }
 
+// Limit returns the memory limit for the cgroup. If no limit is
+// set (the kernel reports a huge sentinel value) physical memory
+// of the machine is returned instead
+func (s *PerCgroupStat) Limit() float64 {
+	limit := s.Limit_In_Bytes.Get()
+	mem := PhysicalMemory()
+	if math.IsNaN(limit) || limit > mem {
+		return mem
+	}
+	return limit
+}
+
+// UsagePct returns memory.usage_in_bytes as percentage of Limit()
+func (s *PerCgroupStat) UsagePct() float64 {
+	return (s.Usage_In_Bytes.Get() / s.Limit()) * 100
+}
+
 func (s *PerCgroupStat) Collect() {
 	file, err := os.Open(s.path + "/" + "memory.stat")
 	if err != nil {
@@ -171,6 +226,14 @@ func (s *PerCgroupStat) Collect() {
 		float64(misc.ReadUintFromFile(
 			s.path + "/" + "memory.soft_limit_in_bytes")))
 
+	s.Usage_In_Bytes.Set(
+		float64(misc.ReadUintFromFile(
+			s.path + "/" + "memory.usage_in_bytes")))
+
+	s.Limit_In_Bytes.Set(
+		float64(misc.ReadUintFromFile(
+			s.path + "/" + "memory.limit_in_bytes")))
+
 	s.UsageInBytes.Set(s.Usage())
 }
 
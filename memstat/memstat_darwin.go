@@ -3,8 +3,11 @@
 package memstat
 
 import (
+	"fmt"
 	"github.com/measure/os/misc"
 	"github.com/measure/metrics"
+	"math"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -19,27 +22,60 @@ import (
 #include <sys/sysctl.h>
 int64_t get_phys_memory() {
  	int mib[2];
-    	int64_t phys_mem;
+    	int64_t phys_mem = 0;
     	size_t length;
 
     	mib[0] = CTL_HW;
     	mib[1] = HW_MEMSIZE;
     	length = sizeof(int64_t);
-    	sysctl(mib, 2, &phys_mem, &length, NULL, 0);
+    	if (sysctl(mib, 2, &phys_mem, &length, NULL, 0) != 0)
+		return -1;
 
 	return phys_mem;
 }
+int get_swap_usage(uint64_t *total, uint64_t *used) {
+	int mib[2];
+	struct xsw_usage xsu;
+	size_t length;
+
+	mib[0] = CTL_VM;
+	mib[1] = VM_SWAPUSAGE;
+	length = sizeof(xsu);
+	if (sysctl(mib, 2, &xsu, &length, NULL, 0) != 0)
+		return -1;
+
+	*total = xsu.xsu_total;
+	*used = xsu.xsu_used;
+	return 0;
+}
 */
 import "C"
 
+var physMem struct {
+	once sync.Once
+	v    float64
+}
+
+// PhysicalMemory returns hw.memsize in bytes or NaN if it
+// can't be read. Read once and cached
+func PhysicalMemory() float64 {
+	physMem.once.Do(func() {
+		physMem.v = math.NaN()
+		if v := C.get_phys_memory(); v > 0 {
+			physMem.v = float64(v)
+		}
+	})
+	return physMem.v
+}
+
 type MemStat struct {
 	Metrics *MemStatMetrics
 	m       *metrics.MetricContext
 }
 
-func New(m *metrics.MetricContext, Step time.Duration) *MemStat {
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *MemStat {
 	s := new(MemStat)
-	s.Metrics = MemStatMetricsNew(m, Step)
+	s.Metrics = MemStatMetricsNew(m, Step, opts...)
 	return s
 }
 
@@ -64,6 +100,36 @@ func (s *MemStat) Total() float64 {
 	return o.Total.Get()
 }
 
+// UsagePct returns Usage() as percentage of Total()
+func (s *MemStat) UsagePct() float64 {
+	return (s.Usage() / s.Total()) * 100
+}
+
+// SwapUsagePct returns swap in use as percentage of swap
+// allocated (vm.swapusage), 0 if there is no swap
+func (s *MemStat) SwapUsagePct() float64 {
+	o := s.Metrics
+	if o.SwapTotal.Get() == 0 {
+		return 0
+	}
+	return (o.SwapUsed.Get() / o.SwapTotal.Get()) * 100
+}
+
+// LastCollect returns time of the last successful Collect()
+func (s *MemStat) LastCollect() time.Time {
+	return s.Metrics.LastCollect()
+}
+
+// LastError returns the error from the last Collect()
+func (s *MemStat) LastError() error {
+	return s.Metrics.LastError()
+}
+
+// SetStep changes the collection interval, see misc.StepTicker
+func (s *MemStat) SetStep(d time.Duration) {
+	s.Metrics.SetStep(d)
+}
+
 type MemStatMetrics struct {
 	Free      *metrics.Gauge
 	Active    *metrics.Gauge
@@ -71,10 +137,14 @@ type MemStatMetrics struct {
 	Wired     *metrics.Gauge
 	Purgeable *metrics.Gauge
 	Total     *metrics.Gauge
+	SwapTotal *metrics.Gauge
+	SwapUsed  *metrics.Gauge
 	Pagesize  C.vm_size_t
+	misc.CollectStatus
+	misc.StepTicker
 }
 
-func MemStatMetricsNew(m *metrics.MetricContext, Step time.Duration) *MemStatMetrics {
+func MemStatMetricsNew(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *MemStatMetrics {
 	c := new(MemStatMetrics)
 
 	// initialize all gauges
@@ -84,7 +154,7 @@ func MemStatMetricsNew(m *metrics.MetricContext, Step time.Duration) *MemStatMet
 	C.host_page_size(C.host_t(host), &c.Pagesize)
 
 	// collect metrics every Step
-	ticker := time.NewTicker(Step)
+	ticker := c.StartTicker(Step, misc.NewOptions(opts...).Jitter)
 	go func() {
 		for _ = range ticker.C {
 			c.Collect()
@@ -104,6 +174,7 @@ func (s *MemStatMetrics) Collect() {
 		C.host_info_t(unsafe.Pointer(&meminfo)), &count)
 
 	if ret != C.KERN_SUCCESS {
+		s.RecordCollect(fmt.Errorf("host_statistics64 failed: %d", ret))
 		return
 	}
 
@@ -112,6 +183,13 @@ func (s *MemStatMetrics) Collect() {
 	s.Inactive.Set(float64(meminfo.inactive_count) * float64(s.Pagesize))
 	s.Wired.Set(float64(meminfo.wire_count) * float64(s.Pagesize))
 	s.Purgeable.Set(float64(meminfo.purgeable_count) * float64(s.Pagesize))
-	s.Total.Set(float64(C.get_phys_memory()))
+	s.Total.Set(PhysicalMemory())
+
+	var swapTotal, swapUsed C.uint64_t
+	if C.get_swap_usage(&swapTotal, &swapUsed) == 0 {
+		s.SwapTotal.Set(float64(swapTotal))
+		s.SwapUsed.Set(float64(swapUsed))
+	}
 
+	s.RecordCollect(nil)
 }
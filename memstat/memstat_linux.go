@@ -10,6 +10,7 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"sync"
 	"time"
 )
 
@@ -20,9 +21,9 @@ type MemStat struct {
 	EnableCgroups bool
 }
 
-func New(m *metrics.MetricContext, Step time.Duration) *MemStat {
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *MemStat {
 	s := new(MemStat)
-	s.Metrics = MemStatMetricsNew(m, Step)
+	s.Metrics = MemStatMetricsNew(m, Step, opts...)
 	return s
 }
 
@@ -44,9 +45,47 @@ func (s *MemStat) Total() float64 {
 	return o.MemTotal.Get()
 }
 
+// UsagePct returns memory in use as percentage of MemTotal, based on
+// MemAvailable. Kernels older than 3.14 don't report MemAvailable,
+// Usage() is used instead
+func (s *MemStat) UsagePct() float64 {
+	o := s.Metrics
+	used := o.MemTotal.Get() - o.MemAvailable.Get()
+	if math.IsNaN(used) {
+		used = s.Usage()
+	}
+	return (used / o.MemTotal.Get()) * 100
+}
+
+// SwapUsagePct returns swap in use as percentage of SwapTotal,
+// 0 if there is no swap
+func (s *MemStat) SwapUsagePct() float64 {
+	o := s.Metrics
+	if o.SwapTotal.Get() == 0 {
+		return 0
+	}
+	return ((o.SwapTotal.Get() - o.SwapFree.Get()) / o.SwapTotal.Get()) * 100
+}
+
+// LastCollect returns time of the last successful Collect()
+func (s *MemStat) LastCollect() time.Time {
+	return s.Metrics.LastCollect()
+}
+
+// LastError returns the error from the last Collect()
+func (s *MemStat) LastError() error {
+	return s.Metrics.LastError()
+}
+
+// SetStep changes the collection interval, see misc.StepTicker
+func (s *MemStat) SetStep(d time.Duration) {
+	s.Metrics.SetStep(d)
+}
+
 type MemStatMetrics struct {
 	MemTotal          *metrics.Gauge
 	MemFree           *metrics.Gauge
+	MemAvailable      *metrics.Gauge
 	Buffers           *metrics.Gauge
 	Cached            *metrics.Gauge
 	SwapCached        *metrics.Gauge
@@ -87,9 +126,11 @@ type MemStatMetrics struct {
 	Hugepagesize      *metrics.Gauge
 	DirectMap4k       *metrics.Gauge
 	DirectMap2M       *metrics.Gauge
+	misc.CollectStatus
+	misc.StepTicker
 }
 
-func MemStatMetricsNew(m *metrics.MetricContext, Step time.Duration) *MemStatMetrics {
+func MemStatMetricsNew(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *MemStatMetrics {
 	c := new(MemStatMetrics)
 
 	// initialize all metrics and register them
@@ -99,7 +140,7 @@ func MemStatMetricsNew(m *metrics.MetricContext, Step time.Duration) *MemStatMet
 	c.Collect()
 
 	// collect metrics every Step
-	ticker := time.NewTicker(Step)
+	ticker := c.StartTicker(Step, misc.NewOptions(opts...).Jitter)
 	go func() {
 		for _ = range ticker.C {
 			c.Collect()
@@ -112,8 +153,10 @@ func MemStatMetricsNew(m *metrics.MetricContext, Step time.Duration) *MemStatMet
 func (s *MemStatMetrics) Collect() {
 	file, err := os.Open("/proc/meminfo")
 	if err != nil {
+		s.RecordCollect(err)
 		return
 	}
+	defer file.Close()
 
 	d := map[string]*metrics.Gauge{}
 	// Get all fields we care about
@@ -121,7 +164,7 @@ func (s *MemStatMetrics) Collect() {
 	typeOfT := r.Type()
 	for i := 0; i < r.NumField(); i++ {
 		f := r.Field(i)
-		if f.Type().Elem() == reflect.TypeOf(metrics.Gauge{}) {
+		if f.Kind() == reflect.Ptr && f.Type().Elem() == reflect.TypeOf(metrics.Gauge{}) {
 			d[typeOfT.Field(i).Name] = f.Interface().(*metrics.Gauge)
 		}
 	}
@@ -134,9 +177,41 @@ func (s *MemStatMetrics) Collect() {
 			parseMemLine(g, f)
 		}
 	}
+	s.RecordCollect(scanner.Err())
 }
 
 // Unexported functions
+
+var physMem struct {
+	once sync.Once
+	v    float64
+}
+
+// PhysicalMemory returns MemTotal from /proc/meminfo in bytes
+// or NaN if it can't be read. Read once and cached
+func PhysicalMemory() float64 {
+	physMem.once.Do(func() {
+		physMem.v = math.NaN()
+		file, err := os.Open("/proc/meminfo")
+		if err != nil {
+			return
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			f := regexp.MustCompile("[:\\s]+").Split(scanner.Text(), 3)
+			if f[0] == "MemTotal" {
+				g := metrics.NewGauge()
+				parseMemLine(g, f)
+				physMem.v = g.Get()
+				return
+			}
+		}
+	})
+	return physMem.v
+}
+
 func parseMemLine(g *metrics.Gauge, f []string) {
 	length := len(f)
 	val := math.NaN()
@@ -4,70 +4,679 @@ package misc
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/measure/metrics"
+	"io"
+	"io/fs"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Interface interface{}
 
+// RootFS is the root of the real filesystem. Collectors which
+// can read from an alternate fs.FS (e.g. a captured /proc
+// snapshot extracted to a directory or held in memory) default
+// to it. Paths are relative to "/", e.g. "proc/stat"
+var RootFS fs.FS = os.DirFS("/")
+
+// ParseUint returns in parsed as a decimal uint64 or 0
+// on error. Use ParseUintErr to tell errors apart from 0
 func ParseUint(in string) uint64 {
-	out, err := strconv.ParseUint(in, 10, 64) // decimal, 64bit
+	out, err := ParseUintErr(in)
 	if err != nil {
 		return 0
 	}
 	return out
 }
 
+// ParseUintErr parses in as a decimal uint64
+func ParseUintErr(in string) (uint64, error) {
+	return strconv.ParseUint(in, 10, 64) // decimal, 64bit
+}
+
+// ReadUintFromFile returns the first line of path parsed as
+// uint64 or 0 on error. Use ReadUintFromFileErr to tell errors
+// apart from 0
 func ReadUintFromFile(path string) uint64 {
+	out, err := ReadUintFromFileErr(path)
+	if err != nil {
+		return 0
+	}
+	return out
+}
+
+// ReadUintFromFileErr returns the first line of path parsed
+// as uint64
+func ReadUintFromFileErr(path string) (uint64, error) {
+	line, err := ReadStringFromFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return ParseUintErr(line)
+}
+
+// WriteUintToFile writes v as a decimal number to the existing
+// file at path, e.g. a cgroup or sysctl setting. Kernel
+// interfaces report invalid values as an error from write(2),
+// which is returned as is
+func WriteUintToFile(path string, v uint64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.FormatUint(v, 10))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadStringFromFile returns the first line of path with
+// leading and trailing white space removed
+func ReadStringFromFile(path string) (string, error) {
 	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
 	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		return strings.TrimSpace(scanner.Text()), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no data in " + path)
+}
+
+// ReadFieldsFromFile returns the first line of path split
+// by sep. An empty sep splits around runs of white space
+func ReadFieldsFromFile(path string, sep string) ([]string, error) {
+	line, err := ReadStringFromFile(path)
 	if err != nil {
-		return 0
+		return nil, err
+	}
+	if sep == "" {
+		return strings.Fields(line), nil
+	}
+	return strings.Split(line, sep), nil
+}
+
+// ReadKVFile parses a file of "key value" lines such as cpu.stat
+// or /proc/<pid>/status into a map. Keys and values are split at
+// the first sep, or the first run of white space if sep is empty,
+// and trimmed. Lines without a separator are skipped
+func ReadKVFile(path string, sep string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
+	ret := make(map[string]string)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		return ParseUint(scanner.Text())
+		line := strings.TrimSpace(scanner.Text())
+		i, n := strings.Index(line, sep), len(sep)
+		if sep == "" {
+			i, n = strings.IndexAny(line, " \t"), 1
+		}
+		if i < 0 {
+			continue
+		}
+		ret[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+n:])
+	}
+	return ret, scanner.Err()
+}
+
+// ReadKVUint is ReadKVFile with values parsed as uint64. Only
+// the first field of a value is parsed so units such as "kB"
+// are ignored; keys with non numeric values are left out
+func ReadKVUint(path string, sep string) (map[string]uint64, error) {
+	kv, err := ReadKVFile(path, sep)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]uint64, len(kv))
+	for k, v := range kv {
+		f := strings.Fields(v)
+		if len(f) == 0 {
+			continue
+		}
+		if n, err := ParseUintErr(f[0]); err == nil {
+			ret[k] = n
+		}
 	}
-	return 0
+	return ret, nil
 }
 
+// InitializeMetrics allocates all *metrics.Gauge, *metrics.Counter
+// and *metrics.Timer fields in the struct pointed to by c and
+// optionally registers them as prefix.FieldName. Embedded structs
+// (or pointers to structs, allocated if nil) are walked using
+// the same prefix.
+//
+// The name segment can be overridden with a "metric" struct tag:
+//
+//	UserLowPrio *metrics.Counter `metric:"nice"`
+//
+// registers the counter as prefix.nice. A tag of "-" allocates
+// the metric without ever registering it
 func InitializeMetrics(c Interface, m *metrics.MetricContext, prefix string, register bool) {
-	s := reflect.ValueOf(c).Elem()
+	initializeMetrics(reflect.ValueOf(c).Elem(), m, prefix, register, Options{})
+	return
+}
+
+// InitializeMetricsOpts is InitializeMetrics honouring o: with
+// o.SkipRawMetrics fields tagged `kind:"raw"` (e.g. the jiffie
+// counters percentages are computed from) are allocated but not
+// registered
+func InitializeMetricsOpts(c Interface, m *metrics.MetricContext, prefix string, register bool, o Options) {
+	initializeMetrics(reflect.ValueOf(c).Elem(), m, prefix, register, o)
+}
+
+func initializeMetrics(s reflect.Value, m *metrics.MetricContext, prefix string, register bool, o Options) {
 	typeOfT := s.Type()
 	for i := 0; i < s.NumField(); i++ {
 		f := s.Field(i)
+		if typeOfT.Field(i).Anonymous {
+			if f.Kind() == reflect.Struct {
+				initializeMetrics(f, m, prefix, register, o)
+				continue
+			}
+			if f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct &&
+				newMetric(f.Type().Elem()) == nil {
+				if f.IsNil() {
+					f.Set(reflect.New(f.Type().Elem()))
+				}
+				initializeMetrics(f.Elem(), m, prefix, register, o)
+				continue
+			}
+		}
 		if f.Kind().String() != "ptr" {
 			continue
 		}
-		if f.Type().Elem() == reflect.TypeOf(metrics.Gauge{}) {
-			name := prefix + "." + typeOfT.Field(i).Name
-			g := metrics.NewGauge()
-			if register {
-				m.Register(g, name)
+		g := newMetric(f.Type().Elem())
+		if g == nil {
+			continue
+		}
+		name, ok := metricName(typeOfT.Field(i))
+		if register && ok && !o.skip(typeOfT.Field(i)) {
+			m.Register(g, prefix+"."+name)
+		}
+		f.Set(reflect.ValueOf(g))
+	}
+}
+
+// UnregisterMetrics is the reverse of InitializeMetrics with
+// register set: it unregisters all metrics in the struct pointed
+// to by c which were registered under prefix. Collectors call it
+// for objects they stop tracking
+func UnregisterMetrics(c Interface, m *metrics.MetricContext, prefix string) {
+	unregisterMetrics(reflect.ValueOf(c).Elem(), m, prefix, Options{})
+}
+
+// UnregisterMetricsOpts undoes InitializeMetricsOpts, o must be
+// the Options c was initialized with
+func UnregisterMetricsOpts(c Interface, m *metrics.MetricContext, prefix string, o Options) {
+	unregisterMetrics(reflect.ValueOf(c).Elem(), m, prefix, o)
+}
+
+func unregisterMetrics(s reflect.Value, m *metrics.MetricContext, prefix string, o Options) {
+	typeOfT := s.Type()
+	for i := 0; i < s.NumField(); i++ {
+		f := s.Field(i)
+		if typeOfT.Field(i).Anonymous {
+			if f.Kind() == reflect.Struct {
+				unregisterMetrics(f, m, prefix, o)
+				continue
+			}
+			if f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct &&
+				!isMetric(f.Type().Elem()) {
+				if !f.IsNil() {
+					unregisterMetrics(f.Elem(), m, prefix, o)
+				}
+				continue
+			}
+		}
+		if f.Kind() != reflect.Ptr || f.IsNil() || !isMetric(f.Type().Elem()) ||
+			o.skip(typeOfT.Field(i)) {
+			continue
+		}
+		if name, ok := metricName(typeOfT.Field(i)); ok {
+			m.Unregister(f.Interface(), prefix+"."+name)
+		}
+	}
+}
+
+// Options holds collector settings, built by NewOptions from the
+// Option arguments of a collector constructor. The zero value
+// is the default
+type Options struct {
+	// SkipRawMetrics allocates but doesn't register metrics tagged
+	// `kind:"raw"`, publishing only the derived values (e.g. cpustat
+	// UsagePct rather than a counter per jiffie column and CPU) to
+	// keep the number of metrics down
+	SkipRawMetrics bool
+	// Jitter is the upper bound of a random delay added before the
+	// first Collect(), so that collectors sharing the same Step
+	// don't all fire at once. The first Collect() happens between
+	// Step and Step+Jitter after the collector is created, later
+	// ones every Step, keeping the offsets. Jitter shouldn't exceed
+	// Step. 0 disables it
+	Jitter time.Duration
+	// CgroupFilter restricts cgroup collectors to cgroups (full
+	// path below their mountpoint) for which it returns true. nil
+	// accepts all cgroups. It is called from the collector's
+	// goroutine
+	CgroupFilter func(path string) bool
+	// PruneGracePeriod is how long a cgroup may have no tasks (or
+	// be gone) before a cgroup collector stops tracking it.
+	// Keeping it across brief task migrations preserves its
+	// counters and rates. 0 leaves the collector's default,
+	// negative prunes a cgroup as soon as it has no tasks. Only
+	// cpustat cgroups support it so far
+	PruneGracePeriod time.Duration
+	// SumProcessTimes makes cpustat cgroups sum /proc/<pid>/stat
+	// of every process even if cpuacct is available
+	SumProcessTimes bool
+}
+
+// Option sets one of the Options
+type Option func(*Options)
+
+// WithoutRawMetrics sets Options.SkipRawMetrics
+func WithoutRawMetrics() Option {
+	return func(o *Options) {
+		o.SkipRawMetrics = true
+	}
+}
+
+// WithJitter sets Options.Jitter
+func WithJitter(d time.Duration) Option {
+	return func(o *Options) {
+		o.Jitter = d
+	}
+}
+
+// WithCgroupFilter sets Options.CgroupFilter
+func WithCgroupFilter(f func(path string) bool) Option {
+	return func(o *Options) {
+		o.CgroupFilter = f
+	}
+}
+
+// WithPruneGracePeriod sets Options.PruneGracePeriod
+func WithPruneGracePeriod(d time.Duration) Option {
+	return func(o *Options) {
+		o.PruneGracePeriod = d
+	}
+}
+
+// WithSumProcessTimes sets Options.SumProcessTimes
+func WithSumProcessTimes() Option {
+	return func(o *Options) {
+		o.SumProcessTimes = true
+	}
+}
+
+// NewOptions returns the default Options with opts applied
+func NewOptions(opts ...Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o Options) skip(f reflect.StructField) bool {
+	return o.SkipRawMetrics && f.Tag.Get("kind") == "raw"
+}
+
+// metricName returns the name segment of metric field f, false
+// if it is tagged `metric:"-"` and never registered
+func metricName(f reflect.StructField) (string, bool) {
+	switch tag := f.Tag.Get("metric"); tag {
+	case "":
+		return f.Name, true
+	case "-":
+		return "", false
+	default:
+		return tag, true
+	}
+}
+
+// newMetric returns a new metric of type t or nil if t
+// isn't a metric type
+func newMetric(t reflect.Type) interface{} {
+	switch t {
+	case reflect.TypeOf(metrics.Gauge{}):
+		return metrics.NewGauge()
+	case reflect.TypeOf(metrics.Counter{}):
+		return metrics.NewCounter()
+	case reflect.TypeOf(metrics.Timer{}):
+		return metrics.NewTimer()
+	}
+	return nil
+}
+
+// isMetric returns true if t is a metric type
+func isMetric(t reflect.Type) bool {
+	switch t {
+	case reflect.TypeOf(metrics.Gauge{}), reflect.TypeOf(metrics.Counter{}),
+		reflect.TypeOf(metrics.Timer{}):
+		return true
+	}
+	return false
+}
+
+// CollectStatus records the time of the last successful Collect()
+// and the error of the last failed one. Collectors embed it and
+// call RecordCollect at the end of every Collect(). A LastCollect()
+// older than a few Steps means the collector isn't working
+type CollectStatus struct {
+	mu          sync.RWMutex
+	lastCollect time.Time
+	lastError   error
+}
+
+// RecordCollect records the outcome of a Collect(). A nil err
+// updates LastCollect() and clears LastError()
+func (c *CollectStatus) RecordCollect(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastError = err
+	if err == nil {
+		c.lastCollect = Now()
+	}
+}
+
+// LastCollect returns time of the last successful Collect()
+// or zero time if there hasn't been one
+func (c *CollectStatus) LastCollect() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastCollect
+}
+
+// LastError returns the error from the last Collect()
+// or nil if it succeeded
+func (c *CollectStatus) LastError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastError
+}
+
+// ParseRangeList expands a range list such as "0-3,7,9-11" as used
+// by cpuset.cpus, /sys/devices/system/cpu/online and IRQ affinity
+// lists into a sorted slice without duplicates. An empty (or all
+// whitespace) list yields an empty slice
+func ParseRangeList(s string) ([]int, error) {
+	ret := make([]int, 0)
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return ret, nil
+	}
+	seen := make(map[int]bool)
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %v", r, err)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			hi, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q: %v", r, err)
 			}
-			f.Set(reflect.ValueOf(g))
 		}
-		if f.Type().Elem() == reflect.TypeOf(metrics.Counter{}) {
-			name := prefix + "." + typeOfT.Field(i).Name
-			g := metrics.NewCounter()
-			if register {
-				m.Register(g, name)
+		if lo < 0 || hi < lo {
+			return nil, fmt.Errorf("invalid range %q", r)
+		}
+		for i := lo; i <= hi; i++ {
+			if !seen[i] {
+				seen[i] = true
+				ret = append(ret, i)
 			}
-			f.Set(reflect.ValueOf(g))
 		}
 	}
-	return
+	sort.Ints(ret)
+	return ret, nil
 }
 
+// OnlineCPUs returns the number of CPUs currently online
+// according to /sys/devices/system/cpu/online, 0 if it can't
+// be read (e.g. on darwin). Unlike runtime.NumCPU() it isn't
+// limited by the affinity mask of this process
+func OnlineCPUs() int {
+	line, err := ReadStringFromFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return 0
+	}
+	cpus, err := ParseRangeList(line)
+	if err != nil {
+		return 0
+	}
+	return len(cpus)
+}
+
+// CounterWidth is the width in bits of kernel counters exported
+// as unsigned long, e.g. the columns of /proc/net/dev and
+// /proc/diskstats. They wrap at 32 bits on 32 bit kernels; this
+// assumes the process runs with the kernel's word size
+const CounterWidth = strconv.IntSize
+
+// WrapCounter turns samples of a kernel counter which may wrap
+// around into a monotonically increasing value to feed to
+// metrics.Counter.Set, so that a wrap between samples doesn't show
+// up as a huge bogus rate. The zero value handles counters of
+// CounterWidth bits
+type WrapCounter struct {
+	Width uint // width of the counter in bits, 0 for CounterWidth
+	last  uint64
+	total uint64
+	seen  bool
+}
+
+// Update records raw, the current value read from the kernel,
+// and returns the unwrapped total
+func (w *WrapCounter) Update(raw uint64) uint64 {
+	if !w.seen {
+		w.seen = true
+		w.last, w.total = raw, raw
+		return raw
+	}
+	width := w.Width
+	if width == 0 {
+		width = CounterWidth
+	}
+	w.total += WrapDelta(w.last, raw, width)
+	w.last = raw
+	return w.total
+}
+
+// WrapDelta returns how much a counter of width bits advanced from
+// prev to cur. If cur is less than prev the counter is assumed to
+// have wrapped once. A 64 bit counter can't wrap in practice, so
+// there a decrease is taken as a reset to 0 (e.g. a device was
+// recreated) and cur is returned
+func WrapDelta(prev, cur uint64, width uint) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	if width >= 64 {
+		return cur
+	}
+	return cur + (1 << width) - prev
+}
+
+// clock is the source of the current time for collectors
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// clockValue wraps the clock so clk always stores the same
+// concrete type, as atomic.Value requires
+type clockValue struct{ clock }
+
+var clk atomic.Value // clockValue
+
+func init() {
+	clk.Store(clockValue{realClock{}})
+}
+
+// Now returns the current time as seen by collectors, time.Now()
+// unless replaced with SetClock
+func Now() time.Time {
+	return clk.Load().(clockValue).Now()
+}
+
+// Since returns the time elapsed since t according to Now()
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// SetClock replaces the clock used by collectors, e.g. with a
+// FakeClock in tests, and returns a function restoring the
+// previous one. It may be called while collectors are running.
+// metrics.Counter.ComputeRate() uses the metrics package's own
+// clock and is not affected; compute rates from Samples instead
+// (see SampleCounter and Rate) for results depending only on
+// this clock
+func SetClock(c interface{ Now() time.Time }) (restore func()) {
+	prev := clk.Load()
+	clk.Store(clockValue{c})
+	return func() { clk.Store(prev) }
+}
+
+// Sample is the value of a counter and the time it was taken
+// according to Now()
+type Sample struct {
+	Value uint64
+	Time  time.Time
+}
+
+// SampleCounter returns the current value of c stamped with Now()
+func SampleCounter(c *metrics.Counter) Sample {
+	return Sample{Value: c.Get(), Time: Now()}
+}
+
+// Rate returns the per second rate at which a counter advanced
+// from sample a to the later sample b, NaN if no time elapsed
+// between them or the counter went backwards (was reset)
+func Rate(a, b Sample) float64 {
+	dt := b.Time.Sub(a.Time).Seconds()
+	if dt <= 0 || b.Value < a.Value {
+		return math.NaN()
+	}
+	return float64(b.Value-a.Value) / dt
+}
+
+// FakeClock is a clock for tests which only moves when told to
+type FakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewFakeClock returns a FakeClock set to t
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t}
+}
+
+// Now returns the current time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// StepTicker holds the ticker driving the collection goroutine
+// of a collector so the interval can be changed at runtime.
+// Collectors embed it and create their ticker with StartTicker
+type StepTicker struct {
+	mu     sync.Mutex
+	ticker *time.Ticker
+	step   time.Duration
+	delay  *time.Timer // pending jitter delay
+}
+
+// StartTicker creates and remembers the ticker for the
+// collection goroutine, delaying its start by a random duration
+// below jitter (see Options.Jitter), no delay if it is 0
+func (t *StepTicker) StartTicker(d time.Duration, jitter time.Duration) *time.Ticker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ticker = time.NewTicker(d)
+	t.step = d
+	if jitter > 0 {
+		t.ticker.Stop()
+		t.delay = time.AfterFunc(time.Duration(rand.Int63n(int64(jitter))), func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.ticker.Reset(t.step)
+			t.delay = nil
+		})
+	}
+	return t.ticker
+}
+
+// SetStep changes the collection interval, it is safe to call
+// from any goroutine. A Collect() in progress completes first;
+// the next one starts d after SetStep. Does nothing if
+// collection was never started or d isn't positive
+func (t *StepTicker) SetStep(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ticker == nil || d <= 0 {
+		return
+	}
+	if t.delay != nil {
+		t.delay.Stop()
+		t.delay = nil
+	}
+	t.ticker.Reset(d)
+	t.step = d
+}
+
+// Step returns the current collection interval
+func (t *StepTicker) Step() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.step
+}
+
+// ErrCgroupNotMounted is returned (possibly wrapped, use errors.Is)
+// when the requested cgroup subsystem or any cgroup filesystem
+// isn't mounted
+var ErrCgroupNotMounted = errors.New("no cgroup mount found")
+
 // move these to cgroup library
 // discover where memory subsystem is mounted
 
@@ -75,12 +684,13 @@ func FindCgroupMount(subsystem string) (string, error) {
 
 	file, err := os.Open("/proc/mounts")
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("find cgroup mount: %w", err)
 	}
+	defer file.Close()
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		f := regexp.MustCompile("[\\s]+").Split(scanner.Text(), 6)
-		if f[2] == "cgroup" {
+		if len(f) > 3 && f[2] == "cgroup" {
 			for _, o := range strings.Split(f[3], ",") {
 				if o == subsystem {
 					return f[1], nil
@@ -88,27 +698,161 @@ func FindCgroupMount(subsystem string) (string, error) {
 			}
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("find cgroup mount: %w", err)
+	}
+
+	return "", fmt.Errorf("%w for %s", ErrCgroupNotMounted, subsystem)
+}
+
+// FindCgroup2Mount returns where the unified (v2) cgroup
+// hierarchy is mounted
+func FindCgroup2Mount() (string, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", fmt.Errorf("find cgroup2 mount: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) > 2 && f[2] == "cgroup2" {
+			return f[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("find cgroup2 mount: %w", err)
+	}
+	return "", fmt.Errorf("%w for cgroup2", ErrCgroupNotMounted)
+}
+
+// cgroup versions returned by CgroupVersion
+const (
+	CGROUP_V1     = 1
+	CGROUP_V2     = 2
+	CGROUP_HYBRID = 3 // v1 controllers and a v2 hierarchy, e.g. systemd hybrid mode
+)
 
-	return "", errors.New("no cgroup mount found")
+var cgroupVersion struct {
+	once sync.Once
+	v    int
+	err  error
 }
 
+// CgroupVersion returns CGROUP_V1, CGROUP_V2 or CGROUP_HYBRID
+// depending on whether cgroup and/or cgroup2 filesystems are
+// mounted according to /proc/mounts. Read once and cached
+func CgroupVersion() (int, error) {
+	cgroupVersion.once.Do(func() {
+		file, err := os.Open("/proc/mounts")
+		if err != nil {
+			cgroupVersion.err = fmt.Errorf("cgroup version: %w", err)
+			return
+		}
+		defer file.Close()
+		cgroupVersion.v, cgroupVersion.err = parseCgroupVersion(file)
+	})
+	return cgroupVersion.v, cgroupVersion.err
+}
+
+func parseCgroupVersion(r io.Reader) (int, error) {
+	var v1, v2 bool
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 3 {
+			continue
+		}
+		switch f[2] {
+		case "cgroup":
+			v1 = true
+		case "cgroup2":
+			v2 = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	switch {
+	case v1 && v2:
+		return CGROUP_HYBRID, nil
+	case v2:
+		return CGROUP_V2, nil
+	case v1:
+		return CGROUP_V1, nil
+	}
+	return 0, ErrCgroupNotMounted
+}
+
+// FindCgroups returns all cgroups below mountpoint that
+// have tasks
 func FindCgroups(mountpoint string) ([]string, error) {
+	return FindCgroupsOpts(mountpoint, FindCgroupsOptions{})
+}
+
+// FindCgroupsOptions controls how FindCgroupsOpts walks a
+// cgroup hierarchy
+type FindCgroupsOptions struct {
+	// MaxDepth bounds how many levels below the mountpoint
+	// are visited; 0 means no limit
+	MaxDepth int
+	// UseProcs decides emptiness using cgroup.procs (processes)
+	// instead of tasks (threads), which is cheaper to read on
+	// cgroups with many threads
+	UseProcs bool
+}
+
+// FindCgroupsOpts returns cgroups below mountpoint that have
+// tasks according to opts. cgroups removed while walking are
+// skipped, other errors are returned
+func FindCgroupsOpts(mountpoint string, opts FindCgroupsOptions) ([]string, error) {
 	cgroups := make([]string, 0, 128)
 
-	_ = filepath.Walk(
+	file := "tasks"
+	if opts.UseProcs {
+		file = "cgroup.procs"
+	}
+
+	err := filepath.Walk(
 		mountpoint,
-		func(path string, f os.FileInfo, _ error) error {
-			if f.IsDir() && path != mountpoint {
-				// skip cgroups with no tasks
-				dat, err := ioutil.ReadFile(path + "/" + "tasks")
-				if err == nil && len(dat) > 0 {
-					cgroups = append(cgroups, path)
+		func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				if path != mountpoint && os.IsNotExist(err) {
+					return nil
 				}
+				return err
+			}
+			if !f.IsDir() || path == mountpoint {
+				return nil
+			}
+			rel, _ := filepath.Rel(mountpoint, path)
+			depth := strings.Count(rel, string(filepath.Separator)) + 1
+			if opts.MaxDepth > 0 && depth > opts.MaxDepth {
+				return filepath.SkipDir
+			}
+			// skip cgroups with no tasks
+			dat, err := ioutil.ReadFile(path + "/" + file)
+			if err == nil && len(dat) > 0 {
+				cgroups = append(cgroups, path)
 			}
 			return nil
 		})
 
-	return cgroups, nil
+	return cgroups, err
+}
+
+// JSONFloat is a float64 that is marshalled as null when it
+// is NaN or infinite, since JSON can't represent those.
+// Rate based metrics are NaN until two samples are collected
+type JSONFloat float64
+
+func (f JSONFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(v)
 }
 
 type ByteSize float64
@@ -126,25 +870,80 @@ const (
 )
 
 func (b ByteSize) String() string {
-	switch {
-	case b >= YB:
-		return fmt.Sprintf("%.2fYB", b/YB)
-	case b >= ZB:
-		return fmt.Sprintf("%.2fZB", b/ZB)
-	case b >= EB:
-		return fmt.Sprintf("%.2fEB", b/EB)
-	case b >= PB:
-		return fmt.Sprintf("%.2fPB", b/PB)
-	case b >= TB:
-		return fmt.Sprintf("%.2fTB", b/TB)
-	case b >= GB:
-		return fmt.Sprintf("%.2fGB", b/GB)
-	case b >= MB:
-		return fmt.Sprintf("%.2fMB", b/MB)
-	case b >= KB:
-		return fmt.Sprintf("%.2fKB", b/KB)
-	}
-	return fmt.Sprintf("%.2fB", b)
+	return b.format(false)
+}
+
+// StringIEC formats b using binary (IEC) suffixes,
+// e.g. 1024 bytes is "1.00KiB"
+func (b ByteSize) StringIEC() string {
+	return b.format(true)
+}
+
+// byteSizeSteps lists the units used by String() and StringIEC(),
+// largest first
+var byteSizeSteps = []struct {
+	size      ByteSize
+	suffix    string
+	suffixIEC string
+}{
+	{YB, "YB", "YiB"}, {ZB, "ZB", "ZiB"}, {EB, "EB", "EiB"},
+	{PB, "PB", "PiB"}, {TB, "TB", "TiB"}, {GB, "GB", "GiB"},
+	{MB, "MB", "MiB"}, {KB, "KB", "KiB"}, {1, "B", "B"},
+}
+
+// format uses the largest unit not exceeding b. A value which
+// would round up to 1024.00 of a unit, e.g. 1048575 bytes, is
+// shown as 1.00 of the next one instead
+func (b ByteSize) format(iec bool) string {
+	i := 0
+	// NaN (not collected yet) ends up in bytes
+	for i < len(byteSizeSteps)-1 && !(b >= byteSizeSteps[i].size) {
+		i++
+	}
+	if i > 0 && b/byteSizeSteps[i].size >= 1023.995 {
+		i--
+	}
+	u := byteSizeSteps[i]
+	if iec {
+		return fmt.Sprintf("%.2f%s", b/u.size, u.suffixIEC)
+	}
+	return fmt.Sprintf("%.2f%s", b/u.size, u.suffix)
+}
+
+var byteSizeUnits = map[string]ByteSize{
+	"": 1, "B": 1,
+	"K": KB, "KB": KB, "KIB": KB,
+	"M": MB, "MB": MB, "MIB": MB,
+	"G": GB, "GB": GB, "GIB": GB,
+	"T": TB, "TB": TB, "TIB": TB,
+	"P": PB, "PB": PB, "PIB": PB,
+	"E": EB, "EB": EB, "EIB": EB,
+	"Z": ZB, "ZB": ZB, "ZIB": ZB,
+	"Y": YB, "YB": YB, "YIB": YB,
+}
+
+// ParseByteSize parses human readable sizes such as "1.50GB",
+// "10 gb", "512KiB" or "42" (bytes) and is the inverse of
+// ByteSize.String(). Suffixes are case-insensitive; like String()
+// both KB and KiB style suffixes are treated as powers of 1024
+func ParseByteSize(s string) (ByteSize, error) {
+	t := strings.TrimSpace(s)
+	i := len(t)
+	for i > 0 && (t[i-1] < '0' || t[i-1] > '9') && t[i-1] != '.' {
+		i--
+	}
+	num := strings.TrimSpace(t[:i])
+	unit := strings.ToUpper(strings.TrimSpace(t[i:]))
+
+	mult, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, t[i:])
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(v) * mult, nil
 }
 
 type BitSize float64
@@ -0,0 +1,750 @@
+// Copyright (c) 2014 Square, Inc
+
+package misc
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+type testMetrics struct {
+	Hits  *metrics.Counter
+	Level *metrics.Gauge `metric:"level"`
+}
+
+func TestUnregisterMetrics(t *testing.T) {
+	m := metrics.NewMetricContext("test")
+	a, b := new(testMetrics), new(testMetrics)
+	InitializeMetrics(a, m, "test.a", true)
+	InitializeMetrics(b, m, "test.b", true)
+	if len(m.Counters) != 2 || len(m.Gauges) != 2 {
+		t.Fatalf("registered %d counters, %d gauges; want 2, 2",
+			len(m.Counters), len(m.Gauges))
+	}
+
+	UnregisterMetrics(a, m, "test.a")
+	if len(m.Counters) != 1 || len(m.Gauges) != 1 {
+		t.Fatalf("after unregister %d counters, %d gauges; want 1, 1",
+			len(m.Counters), len(m.Gauges))
+	}
+	if _, ok := m.Counters["test.b.Hits"]; !ok {
+		t.Errorf("test.b.Hits unregistered")
+	}
+	if _, ok := m.Gauges["test.b.level"]; !ok {
+		t.Errorf("test.b.level unregistered")
+	}
+}
+
+type testRawMetrics struct {
+	Ticks *metrics.Counter `kind:"raw"`
+	Pct   *metrics.Gauge
+}
+
+func TestInitializeMetricsOpts(t *testing.T) {
+	tests := []struct {
+		opts  []Option
+		names []string
+	}{
+		{nil, []string{"test.Ticks", "test.Pct"}},
+		{[]Option{WithoutRawMetrics()}, []string{"test.Pct"}},
+	}
+	for _, tt := range tests {
+		m := metrics.NewMetricContext("test")
+		o := NewOptions(tt.opts...)
+		s := new(testRawMetrics)
+		InitializeMetricsOpts(s, m, "test", true, o)
+		if s.Ticks == nil || s.Pct == nil {
+			t.Fatalf("SkipRawMetrics=%v: metrics not allocated", o.SkipRawMetrics)
+		}
+		if n := len(m.Counters) + len(m.Gauges); n != len(tt.names) {
+			t.Errorf("SkipRawMetrics=%v: registered %d metrics, want %v",
+				o.SkipRawMetrics, n, tt.names)
+		}
+		for _, name := range tt.names {
+			_, c := m.Counters[name]
+			_, g := m.Gauges[name]
+			if !c && !g {
+				t.Errorf("SkipRawMetrics=%v: %s not registered", o.SkipRawMetrics, name)
+			}
+		}
+
+		UnregisterMetricsOpts(s, m, "test", o)
+		if n := len(m.Counters) + len(m.Gauges); n != 0 {
+			t.Errorf("SkipRawMetrics=%v: %d metrics left after unregister",
+				o.SkipRawMetrics, n)
+		}
+	}
+}
+
+func TestStartTickerJitter(t *testing.T) {
+	var a, b StepTicker
+	defer a.StartTicker(time.Hour, 0).Stop()
+	defer b.StartTicker(time.Hour, time.Hour).Stop()
+	if a.delay != nil {
+		t.Errorf("start delayed without jitter")
+	}
+	if b.delay == nil {
+		t.Errorf("start not delayed with jitter")
+	}
+	b.SetStep(time.Minute)
+	if b.delay != nil || b.Step() != time.Minute {
+		t.Errorf("SetStep didn't cancel the jitter delay")
+	}
+}
+
+func TestRateFakeClock(t *testing.T) {
+	fake := NewFakeClock(time.Unix(1700000000, 0))
+	defer SetClock(fake)()
+
+	c := metrics.NewCounter()
+	c.Set(100)
+	a := SampleCounter(c)
+	fake.Advance(2 * time.Second)
+	c.Set(300)
+	b := SampleCounter(c)
+
+	if r := Rate(a, b); r != 100 {
+		t.Errorf("Rate() = %v, want 100", r)
+	}
+	if r := Rate(a, a); !math.IsNaN(r) {
+		t.Errorf("Rate() without elapsed time = %v, want NaN", r)
+	}
+	if r := Rate(b, a); !math.IsNaN(r) {
+		t.Errorf("Rate() of a reset counter = %v, want NaN", r)
+	}
+}
+
+func TestSetClockConcurrent(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			Now()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		SetClock(NewFakeClock(time.Unix(int64(i), 0)))()
+	}
+	<-done
+}
+
+func TestOnlineCPUs(t *testing.T) {
+	line, err := ReadStringFromFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		t.Skip(err)
+	}
+	cpus, _ := ParseRangeList(line)
+	if n := OnlineCPUs(); n == 0 || n != len(cpus) {
+		t.Errorf("OnlineCPUs() = %d, want %d (%q)", n, len(cpus), line)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+		ok   bool
+	}{
+		{"42", 42, true},
+		{"42B", 42, true},
+		{"1.50GB", 1.5 * GB, true},
+		{"10 gb", 10 * GB, true},
+		{"512KiB", 512 * KB, true},
+		{"512kib", 512 * KB, true},
+		{"2M", 2 * MB, true},
+		{" 3 TB ", 3 * TB, true},
+		{"1PB", PB, true},
+		{"0.5", 0.5, true},
+		{".5KB", 512, true},
+		{"", 0, false},
+		{"GB", 0, false},
+		{"10 XB", 0, false},
+		{"1.2.3MB", 0, false},
+		{"-1KB", 0, false},
+		{"10 G B", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseByteSize(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteSize(%q) = %v, want %v", tt.in, float64(got), float64(tt.want))
+		}
+	}
+
+	// inverse of String() and StringIEC()
+	for _, b := range []ByteSize{1, 1023, 1.5 * KB, 100 * MB, 1.25 * TB} {
+		for _, s := range []string{b.String(), b.StringIEC()} {
+			if got, err := ParseByteSize(s); err != nil || got != b {
+				t.Errorf("ParseByteSize(%q) = %v, %v; want %v", s, float64(got), err, float64(b))
+			}
+		}
+	}
+}
+
+func TestParseRangeList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+		ok   bool
+	}{
+		{"", []int{}, true},
+		{" \n", []int{}, true},
+		{"0", []int{0}, true},
+		{"7\n", []int{7}, true},
+		{"0-3", []int{0, 1, 2, 3}, true},
+		{"0-3,7,9-11", []int{0, 1, 2, 3, 7, 9, 10, 11}, true},
+		{"2-2", []int{2}, true},
+		// overlapping and unordered ranges
+		{"0-3,2-5", []int{0, 1, 2, 3, 4, 5}, true},
+		{"8,1-2,1", []int{1, 2, 8}, true},
+		{"0-1, 4", []int{0, 1, 4}, true},
+		{"3-1", nil, false},
+		{"a", nil, false},
+		{"1-", nil, false},
+		{"-1", nil, false},
+		{"1,,2", nil, false},
+		{"1-2-3", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRangeList(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseRangeList(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRangeList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWrapDelta(t *testing.T) {
+	tests := []struct {
+		prev, cur uint64
+		width     uint
+		want      uint64
+	}{
+		{100, 150, 32, 50},
+		{100, 100, 32, 0},
+		{math.MaxUint32 - 9, 5, 32, 15},
+		{math.MaxUint32, 0, 32, 1},
+		{200, 100, 8, 156},
+		{100, 150, 64, 50},
+		// a 64 bit counter going backwards was reset
+		{1000, 10, 64, 10},
+		{math.MaxUint64, 0, 64, 0},
+	}
+	for _, tt := range tests {
+		if got := WrapDelta(tt.prev, tt.cur, tt.width); got != tt.want {
+			t.Errorf("WrapDelta(%d, %d, %d) = %d, want %d",
+				tt.prev, tt.cur, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestWrapCounter(t *testing.T) {
+	tests := []struct {
+		width uint
+		raw   []uint64
+		want  []uint64
+	}{
+		{32, []uint64{10, 20, 30}, []uint64{10, 20, 30}},
+		{32, []uint64{math.MaxUint32 - 1, 3, 10},
+			[]uint64{math.MaxUint32 - 1, math.MaxUint32 + 4, math.MaxUint32 + 11}},
+		// wraps twice
+		{8, []uint64{250, 5, 250, 1}, []uint64{250, 261, 506, 513}},
+		{64, []uint64{100, 50, 70}, []uint64{100, 150, 170}},
+	}
+	for _, tt := range tests {
+		w := WrapCounter{Width: tt.width}
+		for i, raw := range tt.raw {
+			if got := w.Update(raw); got != tt.want[i] {
+				t.Errorf("width %d: Update(%d) #%d = %d, want %d",
+					tt.width, raw, i, got, tt.want[i])
+			}
+		}
+	}
+
+	var w WrapCounter
+	if got := w.Update(42); got != 42 {
+		t.Errorf("zero WrapCounter Update(42) = %d, want 42", got)
+	}
+}
+
+func TestParseCgroupVersion(t *testing.T) {
+	const (
+		root   = "/dev/sda1 / ext4 rw,relatime 0 0\n"
+		proc   = "proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0\n"
+		v1cpu  = "cgroup /sys/fs/cgroup/cpu,cpuacct cgroup rw,cpu,cpuacct 0 0\n"
+		v1mem  = "cgroup /sys/fs/cgroup/memory cgroup rw,memory 0 0\n"
+		v2     = "cgroup2 /sys/fs/cgroup cgroup2 rw,nsdelegate 0 0\n"
+		v2hyb  = "cgroup2 /sys/fs/cgroup/unified cgroup2 rw,nsdelegate 0 0\n"
+		tmpfs  = "tmpfs /sys/fs/cgroup tmpfs ro,mode=755 0 0\n"
+		broken = "cgroup2\n"
+	)
+	tests := []struct {
+		mounts string
+		want   int
+		err    error
+	}{
+		{root + proc + tmpfs + v1cpu + v1mem, CGROUP_V1, nil},
+		{root + proc + v2, CGROUP_V2, nil},
+		{root + tmpfs + v2hyb + v1cpu + v1mem, CGROUP_HYBRID, nil},
+		{root + proc, 0, ErrCgroupNotMounted},
+		{"", 0, ErrCgroupNotMounted},
+		// short lines are skipped
+		{broken + v1mem, CGROUP_V1, nil},
+	}
+	for _, tt := range tests {
+		v, err := parseCgroupVersion(strings.NewReader(tt.mounts))
+		if v != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("parseCgroupVersion(%q) = %d, %v; want %d, %v",
+				tt.mounts, v, err, tt.want, tt.err)
+		}
+	}
+}
+
+// writeTestFile writes data to a new file in a temporary directory
+// and returns its path
+func writeTestFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseUintErr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		err  error
+	}{
+		{"0", 0, nil},
+		{"42", 42, nil},
+		{"18446744073709551615", math.MaxUint64, nil},
+		{"18446744073709551616", 0, strconv.ErrRange},
+		{"-1", 0, strconv.ErrSyntax},
+		{"", 0, strconv.ErrSyntax},
+		{"12kB", 0, strconv.ErrSyntax},
+		{"0x10", 0, strconv.ErrSyntax},
+		{" 5", 0, strconv.ErrSyntax},
+		{"1.5", 0, strconv.ErrSyntax},
+	}
+	for _, tt := range tests {
+		got, err := ParseUintErr(tt.in)
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("ParseUintErr(%q) error = %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if tt.err == nil && got != tt.want {
+			t.Errorf("ParseUintErr(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+		if v := ParseUint(tt.in); v != tt.want {
+			t.Errorf("ParseUint(%q) = %d, want %d", tt.in, v, tt.want)
+		}
+	}
+}
+
+func TestReadUintFromFileErr(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint64
+		err  error
+	}{
+		{"42", 42, nil},
+		// sysfs and cgroup files end with a newline
+		{"42\n", 42, nil},
+		{"  42  \n", 42, nil},
+		// only the first line counts
+		{"7\n8\n", 7, nil},
+		{"18446744073709551616\n", 0, strconv.ErrRange},
+		{"max\n", 0, strconv.ErrSyntax},
+		{"-1\n", 0, strconv.ErrSyntax},
+		{"\n", 0, strconv.ErrSyntax},
+	}
+	for _, tt := range tests {
+		path := writeTestFile(t, tt.data)
+		got, err := ReadUintFromFileErr(path)
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("ReadUintFromFileErr(%q) error = %v, want %v", tt.data, err, tt.err)
+			continue
+		}
+		if tt.err == nil && got != tt.want {
+			t.Errorf("ReadUintFromFileErr(%q) = %d, want %d", tt.data, got, tt.want)
+		}
+		if v := ReadUintFromFile(path); v != tt.want {
+			t.Errorf("ReadUintFromFile(%q) = %d, want %d", tt.data, v, tt.want)
+		}
+	}
+
+	// empty file
+	if _, err := ReadUintFromFileErr(writeTestFile(t, "")); err == nil {
+		t.Errorf("ReadUintFromFileErr() of an empty file succeeded")
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := ReadUintFromFileErr(missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadUintFromFileErr(%s) error = %v, want fs.ErrNotExist", missing, err)
+	}
+	if v := ReadUintFromFile(missing); v != 0 {
+		t.Errorf("ReadUintFromFile(%s) = %d, want 0", missing, v)
+	}
+}
+
+type TestInner struct {
+	Depth *metrics.Gauge
+}
+
+type TestOuter struct {
+	TestInner
+	Count *metrics.Counter
+}
+
+type TestPtrEmbedded struct {
+	Errors *metrics.Counter
+}
+
+type testNestedMetrics struct {
+	// embedded structs are walked with the same prefix,
+	// recursively
+	TestOuter
+	// allocated if nil
+	*TestPtrEmbedded
+	Latency *metrics.Timer
+	// named struct fields aren't walked
+	Sub  TestInner
+	note string
+}
+
+func TestInitializeMetricsNested(t *testing.T) {
+	m := metrics.NewMetricContext("test")
+	s := new(testNestedMetrics)
+	InitializeMetrics(s, m, "test", true)
+
+	if s.Depth == nil || s.Count == nil || s.TestPtrEmbedded == nil ||
+		s.Errors == nil || s.Latency == nil {
+		t.Fatalf("metrics not allocated: %+v", s)
+	}
+	if s.Sub.Depth != nil {
+		t.Errorf("named struct field Sub walked")
+	}
+	if m.Gauges["test.Depth"] != s.Depth {
+		t.Errorf("test.Depth not registered")
+	}
+	if m.Counters["test.Count"] != s.Count {
+		t.Errorf("test.Count not registered")
+	}
+	if m.Counters["test.Errors"] != s.Errors {
+		t.Errorf("test.Errors not registered")
+	}
+	if m.Timers["test.Latency"] != s.Latency {
+		t.Errorf("test.Latency not registered")
+	}
+	if n := len(m.Counters) + len(m.Gauges) + len(m.Timers); n != 4 {
+		t.Errorf("registered %d metrics, want 4", n)
+	}
+
+	// an embedded pointer already set is kept
+	p := &TestPtrEmbedded{}
+	s2 := &testNestedMetrics{TestPtrEmbedded: p}
+	InitializeMetrics(s2, metrics.NewMetricContext("test"), "test", false)
+	if s2.TestPtrEmbedded != p || p.Errors == nil {
+		t.Errorf("embedded pointer replaced or not initialized")
+	}
+
+	UnregisterMetrics(s, m, "test")
+	if n := len(m.Counters) + len(m.Gauges) + len(m.Timers); n != 0 {
+		t.Errorf("%d metrics left after unregister", n)
+	}
+}
+
+type testTaggedMetrics struct {
+	UserLowPrio *metrics.Counter `metric:"nice"`
+	Scratch     *metrics.Gauge   `metric:"-"`
+	Plain       *metrics.Gauge
+}
+
+func TestInitializeMetricsTag(t *testing.T) {
+	m := metrics.NewMetricContext("test")
+	s := new(testTaggedMetrics)
+	InitializeMetrics(s, m, "test", true)
+
+	if s.UserLowPrio == nil || s.Scratch == nil || s.Plain == nil {
+		t.Fatalf("metrics not allocated: %+v", s)
+	}
+	if m.Counters["test.nice"] != s.UserLowPrio {
+		t.Errorf("renamed field not registered as test.nice")
+	}
+	if _, ok := m.Counters["test.UserLowPrio"]; ok {
+		t.Errorf("renamed field registered under its field name")
+	}
+	if m.Gauges["test.Plain"] != s.Plain {
+		t.Errorf("test.Plain not registered")
+	}
+	for name, g := range m.Gauges {
+		if g == s.Scratch {
+			t.Errorf(`field tagged metric:"-" registered as %s`, name)
+		}
+	}
+	if n := len(m.Counters) + len(m.Gauges); n != 2 {
+		t.Errorf("registered %d metrics, want 2", n)
+	}
+
+	// a metric registered by someone else under the name the
+	// skipped field would have had is left alone
+	other := metrics.NewGauge()
+	m.Register(other, "test.Scratch")
+	UnregisterMetrics(s, m, "test")
+	if _, ok := m.Counters["test.nice"]; ok {
+		t.Errorf("test.nice left after unregister")
+	}
+	if m.Gauges["test.Scratch"] != other {
+		t.Errorf("unrelated test.Scratch unregistered")
+	}
+}
+
+// makeCgroupTree creates a hierarchy of depth levels below root
+// with fanout children per cgroup, each with a task
+func makeCgroupTree(tb testing.TB, root string, depth, fanout int) {
+	if depth == 0 {
+		return
+	}
+	for i := 0; i < fanout; i++ {
+		dir := filepath.Join(root, "cg"+strconv.Itoa(i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "tasks"), []byte("1\n"), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		makeCgroupTree(tb, dir, depth-1, fanout)
+	}
+}
+
+func TestFindCgroupsMaxDepth(t *testing.T) {
+	mp := t.TempDir()
+	makeCgroupTree(t, mp, 4, 1)
+	// cgroups without tasks are skipped, not their children
+	if err := os.WriteFile(filepath.Join(mp, "cg0", "cg0", "tasks"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		maxDepth int
+		want     []string
+	}{
+		{0, []string{"cg0", "cg0/cg0/cg0", "cg0/cg0/cg0/cg0"}},
+		{1, []string{"cg0"}},
+		{2, []string{"cg0"}},
+		{3, []string{"cg0", "cg0/cg0/cg0"}},
+		{4, []string{"cg0", "cg0/cg0/cg0", "cg0/cg0/cg0/cg0"}},
+		{10, []string{"cg0", "cg0/cg0/cg0", "cg0/cg0/cg0/cg0"}},
+	}
+	for _, tt := range tests {
+		cgroups, err := FindCgroupsOpts(mp, FindCgroupsOptions{MaxDepth: tt.maxDepth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(cgroups))
+		for _, cgroup := range cgroups {
+			rel, _ := filepath.Rel(mp, cgroup)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MaxDepth %d: FindCgroupsOpts() = %v, want %v", tt.maxDepth, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkFindCgroupsOpts walks a hierarchy 10 levels deep with
+// 2047 cgroups, in full and truncated by MaxDepth
+func BenchmarkFindCgroupsOpts(b *testing.B) {
+	mp := b.TempDir()
+	makeCgroupTree(b, mp, 10, 2)
+
+	for _, maxDepth := range []int{0, 3} {
+		b.Run("MaxDepth="+strconv.Itoa(maxDepth), func(b *testing.B) {
+			opts := FindCgroupsOptions{MaxDepth: maxDepth}
+			for i := 0; i < b.N; i++ {
+				if _, err := FindCgroupsOpts(mp, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadStringFromFile(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+		ok   bool
+	}{
+		{"ext4", "ext4", true},
+		{"ext4\n", "ext4", true},
+		{"ext4\r\n", "ext4", true},
+		{"  0-3,8  \n", "0-3,8", true},
+		// only the first line is returned
+		{"first\nsecond\n", "first", true},
+		// a blank first line is data
+		{"\n", "", true},
+		{"\nsecond\n", "", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ReadStringFromFile(writeTestFile(t, tt.data))
+		if (err == nil) != tt.ok {
+			t.Errorf("ReadStringFromFile(%q) error = %v, want ok %v", tt.data, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ReadStringFromFile(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := ReadStringFromFile(missing); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadStringFromFile(%s) error = %v, want fs.ErrNotExist", missing, err)
+	}
+}
+
+func TestReadFieldsFromFile(t *testing.T) {
+	tests := []struct {
+		data, sep string
+		want      []string
+		ok        bool
+	}{
+		{"cpu  10 20\t30\n", "", []string{"cpu", "10", "20", "30"}, true},
+		{"1:2:3\n", ":", []string{"1", "2", "3"}, true},
+		// empty fields are kept with a separator
+		{"a::b\n", ":", []string{"a", "", "b"}, true},
+		{"a b\nc d\n", "", []string{"a", "b"}, true},
+		{"\n", "", []string{}, true},
+		{"\n", ":", []string{""}, true},
+		{"", "", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ReadFieldsFromFile(writeTestFile(t, tt.data), tt.sep)
+		if (err == nil) != tt.ok {
+			t.Errorf("ReadFieldsFromFile(%q, %q) error = %v, want ok %v", tt.data, tt.sep, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadFieldsFromFile(%q, %q) = %q, want %q", tt.data, tt.sep, got, tt.want)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := ReadFieldsFromFile(missing, ""); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFieldsFromFile(%s) error = %v, want fs.ErrNotExist", missing, err)
+	}
+}
+
+func TestByteSizeStringBoundaries(t *testing.T) {
+	tests := []struct {
+		b         ByteSize
+		want, iec string
+	}{
+		{0, "0.00B", "0.00B"},
+		{1, "1.00B", "1.00B"},
+		{1023, "1023.00B", "1023.00B"},
+		// would be printed as 1024.00B
+		{1023.999, "1.00KB", "1.00KiB"},
+		{1024, "1.00KB", "1.00KiB"},
+		{1025, "1.00KB", "1.00KiB"},
+		{1536, "1.50KB", "1.50KiB"},
+		{MB - 6, "1023.99KB", "1023.99KiB"},
+		// would be printed as 1024.00KiB
+		{MB - 1, "1.00MB", "1.00MiB"},
+		{MB, "1.00MB", "1.00MiB"},
+		{MB + 1, "1.00MB", "1.00MiB"},
+		{GB - 1, "1.00GB", "1.00GiB"},
+		{1.5 * TB, "1.50TB", "1.50TiB"},
+		// no larger unit to step up to
+		{2048 * YB, "2048.00YB", "2048.00YiB"},
+		{ByteSize(math.NaN()), "NaNB", "NaNB"},
+		{-2048, "-2048.00B", "-2048.00B"},
+	}
+	for _, tt := range tests {
+		if got := tt.b.String(); got != tt.want {
+			t.Errorf("ByteSize(%v).String() = %q, want %q", float64(tt.b), got, tt.want)
+		}
+		if got := tt.b.StringIEC(); got != tt.iec {
+			t.Errorf("ByteSize(%v).StringIEC() = %q, want %q", float64(tt.b), got, tt.iec)
+		}
+	}
+}
+
+func TestReadKVFile(t *testing.T) {
+	tests := []struct {
+		name, data, sep string
+		want            map[string]string
+		uints           map[string]uint64
+	}{
+		{
+			name: "cpu.stat",
+			data: "nr_periods 10\nnr_throttled 2\nthrottled_time 123456\n",
+			want: map[string]string{"nr_periods": "10", "nr_throttled": "2",
+				"throttled_time": "123456"},
+			uints: map[string]uint64{"nr_periods": 10, "nr_throttled": 2,
+				"throttled_time": 123456},
+		},
+		{
+			// tabs and runs of spaces, lines without a value
+			name:  "whitespace",
+			data:  "a\t1\nb    2  \n  c 3\nnovalue\n\n",
+			want:  map[string]string{"a": "1", "b": "2", "c": "3"},
+			uints: map[string]uint64{"a": 1, "b": 2, "c": 3},
+		},
+		{
+			name: "/proc/<pid>/status",
+			data: "Name:\ttmux: server\nState:\tS (sleeping)\nVmRSS:\t    4096 kB\n" +
+				"Threads:\t1\nCpus_allowed_list:\t0-3\n",
+			sep: ":",
+			want: map[string]string{"Name": "tmux: server", "State": "S (sleeping)",
+				"VmRSS": "4096 kB", "Threads": "1", "Cpus_allowed_list": "0-3"},
+			// units are ignored, non numeric values left out
+			uints: map[string]uint64{"VmRSS": 4096, "Threads": 1},
+		},
+		{
+			name:  "empty",
+			want:  map[string]string{},
+			uints: map[string]uint64{},
+		},
+	}
+	for _, tt := range tests {
+		path := writeTestFile(t, tt.data)
+		got, err := ReadKVFile(path, tt.sep)
+		if err != nil {
+			t.Errorf("%s: ReadKVFile() error = %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ReadKVFile() = %q, want %q", tt.name, got, tt.want)
+		}
+		uints, err := ReadKVUint(path, tt.sep)
+		if err != nil {
+			t.Errorf("%s: ReadKVUint() error = %v", tt.name, err)
+		} else if !reflect.DeepEqual(uints, tt.uints) {
+			t.Errorf("%s: ReadKVUint() = %v, want %v", tt.name, uints, tt.uints)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := ReadKVFile(missing, ""); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadKVFile(%s) error = %v, want fs.ErrNotExist", missing, err)
+	}
+	if _, err := ReadKVUint(missing, ":"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadKVUint(%s) error = %v, want fs.ErrNotExist", missing, err)
+	}
+}
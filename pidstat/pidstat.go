@@ -1,8 +1,18 @@
 package pidstat
 
 import (
+	"container/heap"
+	"fmt"
 	"math"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/measure/os/misc"
 )
 
 // ProcessStatInterface defines common methods that all
@@ -12,6 +22,12 @@ type ProcessStatInterface interface {
 	ByCPUUsage() []*PerProcessStat
 	ByMemUsage() []*PerProcessStat
 	SetPidFilter(PidFilterFunc)
+	OnExit(func(*PerProcessStat))
+	OnStart(func(*PerProcessStat))
+	Stop()
+	SetStep(time.Duration)
+	LastCollect() time.Time
+	LastError() error
 }
 
 var _ ProcessStatInterface = &ProcessStat{}
@@ -22,13 +38,78 @@ var _ ProcessStatInterface = &ProcessStat{}
 
 type PerProcessStatInterface interface {
 	CPUUsage() float64
+	CPUUsageNormalized() float64
 	MemUsage() float64
+	PeakMemUsage() float64
+	SwapUsage() float64
+	MemUsagePct() float64
+	MemUsageSize() misc.ByteSize
+	VirtualSize() misc.ByteSize
+	MajorFaultRate() float64
+	MinorFaultRate() float64
+	State() string
+	Nice() int
+	Priority() int
+	IsAlive() bool
+	Accessible() bool
+	Cmdline() string
 }
 
 var _ PerProcessStatInterface = &PerProcessStat{}
 
+// CPUUsageNormalized returns CPUUsage() divided by the number of
+// online CPUs as of the last Collect(), 0-100 of the whole machine.
+// CPUUsage() is relative to a single CPU, a process keeping four
+// CPUs busy reports 400
+func (s *PerProcessStat) CPUUsageNormalized() float64 {
+	var n int
+	if s.owner != nil {
+		n = int(atomic.LoadInt32(&s.owner.cpus))
+	}
+	if n == 0 {
+		n = onlineCPUs()
+	}
+	return s.CPUUsage() / float64(n)
+}
+
+// onlineCPUs returns misc.OnlineCPUs(), runtime.NumCPU() where
+// that is unknown
+func onlineCPUs() int {
+	if n := misc.OnlineCPUs(); n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// String returns a one line summary for logging, e.g.
+// "pid=1234 comm=java user=web cpu=12.3% mem=456.00MB"
+func (s *PerProcessStat) String() string {
+	return fmt.Sprintf("pid=%s comm=%s user=%s cpu=%.1f%% mem=%s",
+		s.Pid(), strings.Trim(s.Comm(), "()"), s.User(),
+		s.CPUUsage(), s.MemUsageSize())
+}
+
+// lazyCmdline caches the command line of a process. It isn't
+// read by Collect(): the first Cmdline() call reads it and later
+// calls return the cached value. Safe for concurrent use
+type lazyCmdline struct {
+	mu   sync.Mutex
+	v    string
+	read bool
+}
+
+func (l *lazyCmdline) get(pid string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.read {
+		l.v = readCmdline(pid)
+		l.read = true
+	}
+	return l.v
+}
+
 // ByCPUUsage implements sort.Interface for []*PerProcessStat based on
-// the Usage() method
+// the CPUUsage() method (not normalized)
 type ByCPUUsage []*PerProcessStat
 
 func (a ByCPUUsage) Len() int           { return len(a) }
@@ -36,8 +117,11 @@ func (a ByCPUUsage) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByCPUUsage) Less(i, j int) bool { return a[i].CPUUsage() > a[j].CPUUsage() }
 
 // ByCPUUsage() returns an slice of *PerProcessStat entries sorted
-// by CPU usage
+// by CPU usage. The slice is a snapshot taken under lock, it is
+// not updated by later calls to Collect()
 func (c *ProcessStat) ByCPUUsage() []*PerProcessStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	v := make([]*PerProcessStat, 0)
 	for _, o := range c.Processes {
 		if !math.IsNaN(o.CPUUsage()) {
@@ -55,8 +139,10 @@ func (a ByMemUsage) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByMemUsage) Less(i, j int) bool { return a[i].MemUsage() > a[j].MemUsage() }
 
 // ByMemUsage() returns an slice of *PerProcessStat entries sorted
-// by Memory usage
+// by Memory usage. The slice is a snapshot like ByCPUUsage()
 func (c *ProcessStat) ByMemUsage() []*PerProcessStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	v := make([]*PerProcessStat, 0)
 	for _, o := range c.Processes {
 		if !math.IsNaN(o.MemUsage()) {
@@ -67,12 +153,326 @@ func (c *ProcessStat) ByMemUsage() []*PerProcessStat {
 	return v
 }
 
+// BySwapUsage implements sort.Interface for []*PerProcessStat based on
+// the SwapUsage() method
+type BySwapUsage []*PerProcessStat
+
+func (a BySwapUsage) Len() int           { return len(a) }
+func (a BySwapUsage) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a BySwapUsage) Less(i, j int) bool { return a[i].SwapUsage() > a[j].SwapUsage() }
+
+// BySwapUsage() returns a slice of *PerProcessStat entries sorted
+// by swap usage
+func (c *ProcessStat) BySwapUsage() []*PerProcessStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v := make([]*PerProcessStat, 0)
+	for _, o := range c.Processes {
+		if !math.IsNaN(o.SwapUsage()) {
+			v = append(v, o)
+		}
+	}
+	sort.Sort(BySwapUsage(v))
+	return v
+}
+
+// SortKey selects the metric used to rank processes in Top()
+type SortKey int
+
+const (
+	CPU SortKey = iota // CPUUsage()
+	Mem                // MemUsage()
+	IO                 // IOUsage()
+)
+
+func (k SortKey) value(o *PerProcessStat) float64 {
+	switch k {
+	case CPU:
+		return o.CPUUsage()
+	case Mem:
+		return o.MemUsage()
+	case IO:
+		return o.IOUsage()
+	}
+	return math.NaN()
+}
+
+type topEntry struct {
+	p *PerProcessStat
+	v float64
+}
+
+// topHeap is a min-heap used to keep the n largest entries
+type topHeap []topEntry
+
+func (h topHeap) Len() int            { return len(h) }
+func (h topHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h topHeap) Less(i, j int) bool  { return h[i].v < h[j].v }
+func (h *topHeap) Push(x interface{}) { *h = append(*h, x.(topEntry)) }
+func (h *topHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Top returns upto n *PerProcessStat entries with the highest
+// usage as selected by "by", sorted in descending order.
+// Unlike ByCPUUsage()[:n] it doesn't sort the whole process list
+func (c *ProcessStat) Top(n int, by SortKey) []*PerProcessStat {
+	if n <= 0 {
+		return make([]*PerProcessStat, 0)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := make(topHeap, 0, n)
+	for _, o := range c.Processes {
+		v := by.value(o)
+		if math.IsNaN(v) {
+			continue
+		}
+		if len(h) < n {
+			heap.Push(&h, topEntry{o, v})
+		} else if v > h[0].v {
+			h[0] = topEntry{o, v}
+			heap.Fix(&h, 0)
+		}
+	}
+	v := make([]*PerProcessStat, len(h))
+	for i := len(h) - 1; i >= 0; i-- {
+		v[i] = heap.Pop(&h).(topEntry).p
+	}
+	return v
+}
+
+// UsageSample holds the values of a single process captured
+// by Snapshot()
+type UsageSample struct {
+	CPUUsage float64
+	MemUsage float64
+	IOUsage  float64
+}
+
+func (k SortKey) sample(s UsageSample) float64 {
+	switch k {
+	case CPU:
+		return s.CPUUsage
+	case Mem:
+		return s.MemUsage
+	case IO:
+		return s.IOUsage
+	}
+	return math.NaN()
+}
+
+// ProcessSnapshot maps pid to the values captured by Snapshot()
+type ProcessSnapshot map[string]UsageSample
+
+// Snapshot captures current usage of all tracked processes so
+// a later Delta() can tell what changed in between
+func (c *ProcessStat) Snapshot() ProcessSnapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	snap := make(ProcessSnapshot, len(c.Processes))
+	for pid, o := range c.Processes {
+		snap[pid] = UsageSample{
+			CPUUsage: o.CPUUsage(),
+			MemUsage: o.MemUsage(),
+			IOUsage:  o.IOUsage(),
+		}
+	}
+	return snap
+}
+
+// ProcessDelta is the change of a process' usage since a snapshot
+type ProcessDelta struct {
+	Process *PerProcessStat
+	Delta   float64
+}
+
+type ByDelta []ProcessDelta
+
+func (a ByDelta) Len() int           { return len(a) }
+func (a ByDelta) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByDelta) Less(i, j int) bool { return a[i].Delta > a[j].Delta }
+
+// Delta returns tracked processes sorted by how much the usage
+// selected by "by" grew since prev was taken with Snapshot(),
+// largest increase first. Processes started after prev count
+// from 0; processes without a current value are left out
+func (c *ProcessStat) Delta(prev ProcessSnapshot, by SortKey) []ProcessDelta {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v := make([]ProcessDelta, 0, len(c.Processes))
+	for pid, o := range c.Processes {
+		cur := by.value(o)
+		if math.IsNaN(cur) {
+			continue
+		}
+		var old float64
+		if s, ok := prev[pid]; ok {
+			old = by.sample(s)
+			if math.IsNaN(old) {
+				old = 0
+			}
+		}
+		v = append(v, ProcessDelta{o, cur - old})
+	}
+	sort.Sort(ByDelta(v))
+	return v
+}
+
+// TotalCPUUsage returns the sum of CPUUsage() of all live
+// tracked processes, skipping those without two samples yet
+func (c *ProcessStat) TotalCPUUsage() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var ret float64
+	for _, o := range c.Processes {
+		if u := o.CPUUsage(); o.alive() && !math.IsNaN(u) {
+			ret += u
+		}
+	}
+	return ret
+}
+
+// TotalMemUsage returns the sum of MemUsage() (resident memory
+// in bytes) of all live tracked processes
+func (c *ProcessStat) TotalMemUsage() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var ret float64
+	for _, o := range c.Processes {
+		if u := o.MemUsage(); o.alive() && !math.IsNaN(u) {
+			ret += u
+		}
+	}
+	return ret
+}
+
+// SetMaxProcesses limits the number of tracked processes to n,
+// 0 meaning no limit. When exceeded, Collect() keeps the n
+// processes using the most CPU during that interval and drops the
+// others, see DroppedProcesses. All processes are ranked again on
+// every Collect(), so a dropped process is tracked again once it
+// is among the n busiest. Dropped processes aren't reported to
+// OnExit; OnStart fires each time a process starts being tracked.
+// The limit bounds the number of metrics, not the cost of
+// Collect(): on Linux every process is still read twice per
+// Collect() to rank it, on darwin the cheap task_info calls are
+// still made for all tasks but attributes are only read for the
+// tracked ones
+func (c *ProcessStat) SetMaxProcesses(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxProcesses = n
+}
+
+// ForEach calls f for every tracked process, in no particular
+// order, until f returns false. Unlike ByCPUUsage() it doesn't
+// allocate or sort. The ProcessStat is read locked meanwhile:
+// f must not call methods which modify it (SetPidFilter,
+// SetMaxProcesses, ...) or keep iterating for long, as that
+// delays Collect()
+func (c *ProcessStat) ForEach(f func(*PerProcessStat) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, o := range c.Processes {
+		if !f(o) {
+			return
+		}
+	}
+}
+
+// NumProcesses returns the number of processes currently tracked
+func (c *ProcessStat) NumProcesses() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.Processes)
+}
+
+// Process returns the tracked *PerProcessStat for pid or nil if
+// pid isn't tracked. Entries are replaced on every Collect() so
+// look the pid up again rather than holding on to the result
+func (c *ProcessStat) Process(pid int) *PerProcessStat {
+	o, _ := c.ByPID(strconv.Itoa(pid))
+	return o
+}
+
+// ByPID returns the tracked *PerProcessStat for pid and whether
+// it was found
+func (c *ProcessStat) ByPID(pid string) (*PerProcessStat, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	o, ok := c.Processes[pid]
+	return o, ok
+}
+
+// ByComm returns all tracked processes whose command name is
+// name, e.g. "java"
+func (c *ProcessStat) ByComm(name string) []*PerProcessStat {
+	name = strings.Trim(name, "()")
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v := make([]*PerProcessStat, 0)
+	for _, o := range c.Processes {
+		if strings.Trim(o.Comm(), "()") == name {
+			v = append(v, o)
+		}
+	}
+	return v
+}
+
+// IsAlive returns true if pid was found by the last Collect()
+func (c *ProcessStat) IsAlive(pid int) bool {
+	return c.Process(pid) != nil
+}
+
+// CountByState returns number of processes currently in
+// state, e.g. 'D' for uninterruptible sleep
+func (c *ProcessStat) CountByState(state byte) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := 0
+	for _, o := range c.Processes {
+		st := o.State()
+		if len(st) > 0 && st[0] == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Zombies returns a slice of *PerProcessStat entries
+// for processes in zombie state
+func (c *ProcessStat) Zombies() []*PerProcessStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v := make([]*PerProcessStat, 0)
+	for _, o := range c.Processes {
+		st := o.State()
+		if len(st) > 0 && st[0] == 'Z' {
+			v = append(v, o)
+		}
+	}
+	return v
+}
+
 type PidFilterFunc func(pidstat *PerProcessStat) (interested bool)
 
 func (f PidFilterFunc) Filter(pidstat *PerProcessStat) (interested bool) {
 	return f(pidstat)
 }
 
+// FilterUserspaceOnly returns a PidFilterFunc which excludes
+// kernel threads, see PerProcessStat.IsKernelThread(). Without
+// a filter (the default) kernel threads are tracked as well
+func FilterUserspaceOnly() PidFilterFunc {
+	return PidFilterFunc(func(pidstat *PerProcessStat) bool {
+		return !pidstat.IsKernelThread()
+	})
+}
+
 func defaultPidFilter(pidstat *PerProcessStat) bool {
 	return true
 }
@@ -3,11 +3,20 @@
 package pidstat
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"github.com/measure/os/misc"
 	"github.com/measure/metrics"
+	"github.com/measure/os/memstat"
+	"github.com/measure/os/misc"
+	"math"
 	"os/user"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -29,6 +38,22 @@ int get_process_info(struct kinfo_proc *kp, pid_t pid)
 	kp->kp_proc.p_comm[0] = '\0'; // jic
 	return sysctl((int *)name, sizeof(name)/sizeof(*name), kp, &len, NULL, 0);
 }
+int get_argmax(void)
+{
+	int argmax;
+	size_t len = sizeof(argmax);
+	int name[] = { CTL_KERN, KERN_ARGMAX };
+	if (sysctl(name, 2, &argmax, &len, NULL, 0) != 0) {
+		return 0;
+	}
+	return argmax;
+}
+int get_process_args(pid_t pid, char *buf, size_t *len)
+{
+	int name[] = { CTL_KERN, KERN_PROCARGS2, 0 };
+	name[2] = pid;
+	return sysctl(name, 3, buf, len, NULL, 0);
+}
 uint64_t absolute_to_nano(uint64_t abs)
 {
 	static mach_timebase_info_data_t s_timebase_info;
@@ -44,10 +69,32 @@ import "C"
 
 const NS = 1 * 1000 * 1000 * 1000
 
+// ProcessStat tracks all processes. Processes is updated by
+// Collect(); use the accessor methods rather than reading
+// it directly from another goroutine
 type ProcessStat struct {
 	Processes map[string]*PerProcessStat
-	m         *metrics.MetricContext
-	hport     C.host_t
+	// number of processes tracked, updated by Collect()
+	ProcessCount *metrics.Gauge
+	// number of processes dropped by the last Collect()
+	// to stay within SetMaxProcesses()
+	DroppedProcesses *metrics.Gauge
+	maxProcesses     int
+	dropped          int               // live processes not tracked at maxProcesses
+	cpuTimes         map[string]uint64 // ns of CPU time of every task, see rank()
+	mu               sync.RWMutex
+	m                *metrics.MetricContext
+	hport            C.host_t
+	pset             C.processor_set_name_t
+	psetPriv         C.processor_set_t // cached by collect()
+	onExit           func(*PerProcessStat)
+	onStart          func(*PerProcessStat)
+	policy           AttributePolicy
+	filter           PidFilterFunc
+	cancel           context.CancelFunc
+	cpus             int32 // onlineCPUs() as of the last Collect(), atomic
+	misc.CollectStatus
+	misc.StepTicker
 }
 
 // NewProcessStat allocates a new ProcessStat object
@@ -57,71 +104,222 @@ type ProcessStat struct {
 // Collects metrics every Step seconds
 // Drops refresh interval by Step for every additional
 // 1024 processes
+// Attributes of known processes are refreshed according
+// to DefaultAttributePolicy, see SetAttributePolicy()
 // TODO: Implement better heuristics to manage load
 //   * Collect metrics for newer processes at faster rate
 //   * Slower rate for processes with neglible rate?
 
-func NewProcessStat(m *metrics.MetricContext, Step time.Duration) *ProcessStat {
+func NewProcessStat(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *ProcessStat {
+	return NewProcessStatWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewProcessStatWithContext allocates a new ProcessStat object
+// which stops collecting metrics and releases the host port once
+// ctx is done or Stop() is called
+func NewProcessStatWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *ProcessStat {
 	c := new(ProcessStat)
 	c.m = m
 
 	c.Processes = make(map[string]*PerProcessStat, 1024)
+	c.ProcessCount = metrics.NewGauge()
+	m.Register(c.ProcessCount, "pidstat.process_count")
+	c.DroppedProcesses = metrics.NewGauge()
+	m.Register(c.DroppedProcesses, "pidstat.dropped_processes")
 	c.hport = C.host_t(C.mach_host_self())
+	c.policy = DefaultAttributePolicy
+	c.filter = PidFilterFunc(defaultPidFilter)
 
 	var n int
-	ticker := time.NewTicker(Step)
+	ctx, c.cancel = context.WithCancel(ctx)
+	ticker := c.StartTicker(Step, misc.NewOptions(opts...).Jitter)
 	go func() {
-		for _ = range ticker.C {
-			p := int(len(c.Processes) / 1024)
-			if n == 0 {
-				c.Collect(true)
-			}
-			// always collect all metrics for first two samples
-			// and if number of processes < 1024
-			if p < 1 || n%p == 0 {
-				c.Collect(false)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.mu.RLock()
+				p := int(len(c.Processes) / 1024)
+				c.mu.RUnlock()
+				if n == 0 {
+					c.Collect(true)
+				}
+				// always collect all metrics for first two samples
+				// and if number of processes < 1024
+				if p < 1 || n%p == 0 {
+					c.Collect(false)
+				}
+				n++
+			case <-ctx.Done():
+				// release ports from the collection goroutine
+				// so they are never in use by Collect()
+				c.mu.Lock()
+				c.releasePorts()
+				c.m.Unregister(c.ProcessCount, "pidstat.process_count")
+				c.m.Unregister(c.DroppedProcesses, "pidstat.dropped_processes")
+				c.mu.Unlock()
+				return
 			}
-			n++
 		}
 	}()
 
 	return c
 }
 
-// not implemented on darwin
+// Stop stops periodic collection, releases the host port and
+// unregisters metrics. A Collect() in progress is allowed to finish
+func (s *ProcessStat) Stop() {
+	s.cancel()
+}
+
+// SetPidFilter sets a filter applied to processes when they
+// are first seen, with their attributes collected. It is called
+// from Collect() with the ProcessStat locked and must not call
+// ProcessStat methods
 func (s *ProcessStat) SetPidFilter(filter PidFilterFunc) {
-	return
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = filter
+}
+
+// IdleCPUThreshold is the CPUUsage() (percent) below which
+// a process counts as idle in ProcessSample.IdleSamples
+var IdleCPUThreshold = 0.1
+
+// ProcessSample describes the collection history of a
+// process to an AttributePolicy
+type ProcessSample struct {
+	Age         int // samples since the process was first seen
+	IdleSamples int // consecutive samples below IdleCPUThreshold
+}
+
+// AttributePolicy decides whether Collect() refreshes the
+// attributes (comm, user, state, nice) of a known process.
+// Attributes of new processes are always collected
+type AttributePolicy interface {
+	RefreshAttributes(p *PerProcessStat, s ProcessSample) bool
+}
+
+// AdaptivePolicy refreshes attributes on every sample for
+// processes first seen less than Recent samples ago, every
+// ActiveInterval samples for busy processes and backs off to
+// every IdleInterval samples for processes which have been idle
+// for IdleAfter samples. An interval of 0 disables refresh
+type AdaptivePolicy struct {
+	Recent         int
+	ActiveInterval int
+	IdleAfter      int
+	IdleInterval   int
+}
+
+func (a *AdaptivePolicy) RefreshAttributes(p *PerProcessStat, s ProcessSample) bool {
+	if s.Age < a.Recent {
+		return true
+	}
+	interval := a.ActiveInterval
+	if s.IdleSamples >= a.IdleAfter {
+		interval = a.IdleInterval
+	}
+	return interval > 0 && s.Age%interval == 0
+}
+
+// FixedPolicy never refreshes attributes of known processes;
+// they are collected when a process is first seen and when
+// Collect(true) is called
+type FixedPolicy struct{}
+
+func (FixedPolicy) RefreshAttributes(p *PerProcessStat, s ProcessSample) bool {
+	return false
+}
+
+// DefaultAttributePolicy is the policy used by NewProcessStat.
+// FixedPolicy keeps attributes of known processes until
+// Collect(true), pass an AdaptivePolicy such as
+// RecommendedAdaptivePolicy to SetAttributePolicy to have them
+// refreshed
+var DefaultAttributePolicy AttributePolicy = FixedPolicy{}
+
+// RecommendedAdaptivePolicy refreshes new processes for their
+// first 5 samples, busy ones every 10 and idle ones every 60
+var RecommendedAdaptivePolicy = &AdaptivePolicy{
+	Recent:         5,
+	ActiveInterval: 10,
+	IdleAfter:      10,
+	IdleInterval:   60,
+}
+
+// SetAttributePolicy replaces the policy used to decide when
+// attributes of known processes are refreshed
+func (s *ProcessStat) SetAttributePolicy(p AttributePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = p
+}
+
+// OnExit registers a callback invoked from Collect() for every
+// tracked process that has exited, just before it is removed.
+// The callback runs synchronously so the *PerProcessStat is
+// still valid; it fires at most once per pid
+func (s *ProcessStat) OnExit(f func(*PerProcessStat)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onExit = f
+}
+
+// OnStart registers a callback invoked from Collect() for every
+// process seen for the first time, once its metrics and attributes
+// have been collected. Like OnExit it runs synchronously; for a
+// given pid OnStart always fires before OnExit, and within a single
+// Collect() all OnStart callbacks run before any OnExit callbacks.
+// With SetMaxProcesses it fires again for a dropped process once
+// it is tracked again
+func (s *ProcessStat) OnStart(f func(*PerProcessStat)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onStart = f
 }
 
 // reference /usr/include/mach/task_info.h
 // works on MacOSX 10.9.2; YMMV might vary
 
 func (c *ProcessStat) Collect(collectAttributes bool) {
+	atomic.StoreInt32(&c.cpus, int32(onlineCPUs()))
+	c.mu.Lock()
+	started, err := c.collect(collectAttributes)
+	onStart := c.onStart
+	c.mu.Unlock()
 
-	h := c.Processes
-	for _, v := range h {
-		v.dead = true
+	if err == nil {
+		if onStart != nil {
+			for _, v := range started {
+				onStart(v)
+			}
+		}
+		c.removeDead()
 	}
+	c.RecordCollect(err)
+}
+
+// collect updates c.Processes from the task list and marks
+// processes which weren't found as dead. Returns processes seen
+// for the first time or an error if the task list couldn't be
+// read. Must be called with c.mu held
+func (c *ProcessStat) collect(collectAttributes bool) ([]*PerProcessStat, error) {
 
-	var pDefaultSet C.processor_set_name_t
-	var pDefaultSetControl C.processor_set_t
 	var tasks C.task_array_t
 	var taskCount C.mach_msg_type_number_t
 
-	if C.processor_set_default(c.hport, &pDefaultSet) != C.KERN_SUCCESS {
-		return
-	}
-
-	// get privileged port to get information about all tasks
-
-	if C.host_processor_set_priv(C.host_priv_t(c.hport),
-		pDefaultSet, &pDefaultSetControl) != C.KERN_SUCCESS {
-		return
+	if err := c.processorSetPriv(); err != nil {
+		return nil, err
 	}
 
-	if C.processor_set_tasks(pDefaultSetControl, &tasks, &taskCount) != C.KERN_SUCCESS {
-		return
+	if kr := C.processor_set_tasks(c.psetPriv, &tasks, &taskCount); kr != C.KERN_SUCCESS {
+		// the cached port may have gone stale, fetch it
+		// again on the next Collect()
+		c.releasePsetPorts()
+		return nil, fmt.Errorf("processor_set_tasks failed: %d", kr)
 	}
+	defer releaseTasks(tasks, taskCount)
 
 	// convert tasks to a Go slice
 	hdr := reflect.SliceHeader{
@@ -132,77 +330,292 @@ func (c *ProcessStat) Collect(collectAttributes bool) {
 
 	goTaskList := *(*[]C.task_name_t)(unsafe.Pointer(&hdr))
 
+	// read the cheap per task counters of every task first,
+	// they are needed to pick the tasks to track
+	infos := make([]taskInfo, 0, taskCount)
+	cpuTimes := make(map[string]uint64, taskCount)
+
 	// mach_msg_type_number_t - type natural_t = uint32_t
 	var i uint32
 	for i = 0; i < uint32(taskCount); i++ {
 
 		taskId := goTaskList[i]
-		var pid C.int
+		var t taskInfo
 		// var tinfo C.task_info_data_t
 		var count C.mach_msg_type_number_t
-		var taskBasicInfo C.mach_task_basic_info_data_t
-		var taskAbsoluteInfo C.task_absolutetime_info_data_t
 
-		if (C.pid_for_task(C.mach_port_name_t(taskId), &pid) != C.KERN_SUCCESS) ||
-			(pid < 0) {
+		if (C.pid_for_task(C.mach_port_name_t(taskId), &t.pid) != C.KERN_SUCCESS) ||
+			(t.pid < 0) {
 			continue
 		}
 
 		count = C.MACH_TASK_BASIC_INFO_COUNT
 		kr := C.task_info(taskId, C.MACH_TASK_BASIC_INFO,
-			(C.task_info_t)(unsafe.Pointer(&taskBasicInfo)),
+			(C.task_info_t)(unsafe.Pointer(&t.basic)),
 			&count)
 		if kr != C.KERN_SUCCESS {
 			continue
 		}
+		t.spid = fmt.Sprintf("%v", t.pid)
+
+		count = C.TASK_EVENTS_INFO_COUNT
+		kr = C.task_info(taskId, C.TASK_EVENTS_INFO,
+			(C.task_info_t)(unsafe.Pointer(&t.events)),
+			&count)
+		t.eventsOK = kr == C.KERN_SUCCESS
+
+		count = C.TASK_ABSOLUTETIME_INFO_COUNT
+		kr = C.task_info(taskId, C.TASK_ABSOLUTETIME_INFO,
+			(C.task_info_t)(unsafe.Pointer(&t.absolute)),
+			&count)
+		t.absoluteOK = kr == C.KERN_SUCCESS
+		if t.absoluteOK {
+			cpuTimes[t.spid] = uint64(C.absolute_to_nano(t.absolute.total_user)) +
+				uint64(C.absolute_to_nano(t.absolute.total_system))
+		}
+		infos = append(infos, t)
+	}
+	tracked := c.rank(infos, cpuTimes)
+	c.cpuTimes = cpuTimes
 
-		spid := fmt.Sprintf("%v", pid)
+	h := c.Processes
+	// tracked pids found in the task list, the others are
+	// marked dead once it has been walked
+	seen := make(map[string]bool, len(h))
+	started := make([]*PerProcessStat, 0)
+	c.dropped = 0
+
+	for _, t := range infos {
+		spid := t.spid
 		pidstat, ok := h[spid]
+		// collecting attributes is what's expensive here,
+		// don't track more processes than allowed
+		if tracked != nil && !tracked[spid] {
+			if ok {
+				delete(h, spid)
+			}
+			c.dropped++
+			continue
+		}
 		if !ok {
 			pidstat = NewPerProcessStat(c.m, spid)
+			pidstat.owner = c
 			h[spid] = pidstat
 		}
 
-		if collectAttributes || !ok {
-			pidstat.CollectAttributes(pid)
+		if ok {
+			pidstat.sample.Age++
+		}
+		if collectAttributes || !ok ||
+			(c.policy != nil && c.policy.RefreshAttributes(pidstat, pidstat.sample)) {
+			pidstat.CollectAttributes(t.pid)
 		}
+		if !ok {
+			if !c.filter(pidstat) {
+				delete(h, spid)
+				continue
+			}
+			started = append(started, pidstat)
+		}
+		seen[spid] = true
 
-		pidstat.Metrics.VirtualSize.Set(float64(taskBasicInfo.virtual_size))
-		pidstat.Metrics.ResidentSize.Set(float64(taskBasicInfo.resident_size))
-		pidstat.Metrics.ResidentSizeMax.Set(float64(taskBasicInfo.resident_size_max))
+		pidstat.Metrics.VirtualSize.Set(float64(t.basic.virtual_size))
+		pidstat.Metrics.ResidentSize.Set(float64(t.basic.resident_size))
+		pidstat.Metrics.ResidentSizeMax.Set(float64(t.basic.resident_size_max))
 
-		count = C.TASK_ABSOLUTETIME_INFO_COUNT
-		kr = C.task_info(taskId, C.TASK_ABSOLUTETIME_INFO,
-			(C.task_info_t)(unsafe.Pointer(&taskAbsoluteInfo)),
-			&count)
-		if kr != C.KERN_SUCCESS {
+		if t.eventsOK {
+			pidstat.Metrics.Faults.Set(uint64(t.events.faults))
+			pidstat.Metrics.Pageins.Set(uint64(t.events.pageins))
+		}
+
+		if !t.absoluteOK {
+			// keep tracking the process, but without CPU times
+			pidstat.inaccessible = true
 			continue
 		}
+		pidstat.inaccessible = false
 		pidstat.Metrics.UserTime.Set(
-			uint64(C.absolute_to_nano(taskAbsoluteInfo.total_user)))
+			uint64(C.absolute_to_nano(t.absolute.total_user)))
 		pidstat.Metrics.SystemTime.Set(
-			uint64(C.absolute_to_nano(taskAbsoluteInfo.total_system)))
-		pidstat.dead = false
+			uint64(C.absolute_to_nano(t.absolute.total_system)))
+		if u := pidstat.CPUUsage(); !math.IsNaN(u) && u < IdleCPUThreshold {
+			pidstat.sample.IdleSamples++
+		} else {
+			pidstat.sample.IdleSamples = 0
+		}
+	}
+	for pid, v := range h {
+		if !seen[pid] {
+			v.dead = true
+		}
+	}
+
+	return started, nil
+}
+
+// taskInfo holds what collect() reads for every task before
+// deciding which ones to track
+type taskInfo struct {
+	pid        C.int
+	spid       string
+	basic      C.mach_task_basic_info_data_t
+	events     C.task_events_info_data_t
+	eventsOK   bool
+	absolute   C.task_absolutetime_info_data_t
+	absoluteOK bool
+}
+
+// rank returns the pids of the maxProcesses tasks which used the
+// most CPU since the previous Collect() according to cpuTimes,
+// or nil if all tasks are to be tracked. All tasks are ranked on
+// every Collect(), so a task left out is tracked again once it
+// becomes busy. Tasks without a previous sample (new ones) come
+// after those with one, tracked ones before others using the same
+// CPU time. Must be called with c.mu held
+func (c *ProcessStat) rank(infos []taskInfo, cpuTimes map[string]uint64) map[string]bool {
+	if c.maxProcesses <= 0 || len(infos) <= c.maxProcesses {
+		return nil
+	}
+	delta := make(map[string]int64, len(infos))
+	for _, t := range infos {
+		delta[t.spid] = -1
+		prev, ok := c.cpuTimes[t.spid]
+		if cur, curOK := cpuTimes[t.spid]; ok && curOK && cur >= prev {
+			delta[t.spid] = int64(cur - prev)
+		}
+	}
+	v := make([]string, 0, len(infos))
+	for _, t := range infos {
+		v = append(v, t.spid)
+	}
+	sort.Slice(v, func(i, j int) bool {
+		if delta[v[i]] != delta[v[j]] {
+			return delta[v[i]] > delta[v[j]]
+		}
+		_, a := c.Processes[v[i]]
+		_, b := c.Processes[v[j]]
+		return a && !b
+	})
+
+	tracked := make(map[string]bool, c.maxProcesses)
+	for _, pid := range v[:c.maxProcesses] {
+		tracked[pid] = true
+	}
+	return tracked
+}
+
+// processorSetPriv fetches the privileged port of the default
+// processor set once and keeps it for later Collect() calls,
+// the lookup is a round trip to the kernel per port. Mach port
+// names are valid for the whole task so the collection goroutine
+// doesn't need to be pinned to an OS thread. Must be called with
+// c.mu held
+func (c *ProcessStat) processorSetPriv() error {
+	if c.psetPriv != 0 {
+		return nil
+	}
+	if c.pset == 0 {
+		if kr := C.processor_set_default(c.hport, &c.pset); kr != C.KERN_SUCCESS {
+			c.pset = 0
+			return fmt.Errorf("processor_set_default failed: %d", kr)
+		}
+	}
+
+	// get privileged port to get information about all tasks
+
+	if kr := C.host_processor_set_priv(C.host_priv_t(c.hport),
+		c.pset, &c.psetPriv); kr != C.KERN_SUCCESS {
+		c.psetPriv = 0
+		return fmt.Errorf("host_processor_set_priv failed: %d", kr)
+	}
+	return nil
+}
+
+// releasePsetPorts drops the cached processor set ports. Must
+// be called with c.mu held
+func (c *ProcessStat) releasePsetPorts() {
+	if c.psetPriv != 0 {
+		C.mach_port_deallocate(C.mach_task_self_,
+			C.mach_port_name_t(c.psetPriv))
+		c.psetPriv = 0
+	}
+	if c.pset != 0 {
+		C.mach_port_deallocate(C.mach_task_self_,
+			C.mach_port_name_t(c.pset))
+		c.pset = 0
 	}
+}
+
+// releasePorts drops the cached processor set ports and the host
+// port. Must be called with c.mu held
+func (c *ProcessStat) releasePorts() {
+	c.releasePsetPorts()
+	C.mach_port_deallocate(C.mach_task_self_,
+		C.mach_port_name_t(c.hport))
+}
 
-	// remove dead processes
-	for k, v := range h {
+// releaseTasks frees the task ports and the array returned by
+// processor_set_tasks
+func releaseTasks(tasks C.task_array_t, taskCount C.mach_msg_type_number_t) {
+	hdr := reflect.SliceHeader{
+		Data: uintptr(unsafe.Pointer(tasks)),
+		Len:  int(taskCount),
+		Cap:  int(taskCount),
+	}
+	for _, t := range *(*[]C.task_t)(unsafe.Pointer(&hdr)) {
+		C.mach_port_deallocate(C.mach_task_self_, C.mach_port_name_t(t))
+	}
+	C.vm_deallocate(C.mach_task_self_, C.vm_address_t(uintptr(unsafe.Pointer(tasks))),
+		C.vm_size_t(uintptr(taskCount)*unsafe.Sizeof(*tasks)))
+}
+
+// removeDead removes processes marked dead by collect(), calling
+// the OnExit callback first. Callbacks run without c.mu held so
+// they can use ProcessStat methods
+func (c *ProcessStat) removeDead() {
+	c.mu.RLock()
+	exited := make([]*PerProcessStat, 0)
+	for _, v := range c.Processes {
 		if v.dead {
-			delete(h, k)
+			exited = append(exited, v)
 		}
 	}
+	onExit := c.onExit
+	c.mu.RUnlock()
 
+	if onExit != nil {
+		for _, v := range exited {
+			onExit(v)
+		}
+	}
+
+	c.mu.Lock()
+	for _, v := range exited {
+		delete(c.Processes, v.pid)
+	}
+	c.DroppedProcesses.Set(float64(c.dropped))
+	c.ProcessCount.Set(float64(len(c.Processes)))
+	c.mu.Unlock()
 }
 
 // Per Process functions
 type PerProcessStat struct {
-	pid     string
-	Uid     int
-	user    string
-	comm    string
-	Metrics *PerProcessStatMetrics
-	m       *metrics.MetricContext
-	dead    bool
+	pid      string
+	Uid      int
+	user     string
+	comm     string
+	state    string
+	nice     int
+	priority int
+	system   bool
+	Metrics  *PerProcessStatMetrics
+	m        *metrics.MetricContext
+	dead     bool
+	owner    *ProcessStat // set once tracked, see IsAlive()
+	sample   ProcessSample
+	// task_absolutetime_info failed, see Accessible()
+	inaccessible bool
+	cmdline      lazyCmdline
 }
 
 func NewPerProcessStat(m *metrics.MetricContext, p string) *PerProcessStat {
@@ -213,18 +626,111 @@ func NewPerProcessStat(m *metrics.MetricContext, p string) *PerProcessStat {
 	return c
 }
 
-// CPUUsage() returns current cpu usage percent, user+system for process
+// CPUUsage() returns current cpu usage percent, user+system for process.
+// NaN if the process isn't Accessible()
 func (s *PerProcessStat) CPUUsage() float64 {
+	if s.inaccessible {
+		return math.NaN()
+	}
 	o := s.Metrics
 	rate_ns := o.UserTime.ComputeRate() + o.SystemTime.ComputeRate()
 	return (rate_ns / float64(NS)) * 100
 }
 
+// Nice returns nice value of the process (-20 to 20).
+// Refreshed along with other attributes
+func (s *PerProcessStat) Nice() int {
+	return s.nice
+}
+
+// Priority returns scheduling priority of the process.
+// Refreshed along with other attributes
+func (s *PerProcessStat) Priority() int {
+	return s.priority
+}
+
+// MajorFaultRate returns page-ins per second
+func (s *PerProcessStat) MajorFaultRate() float64 {
+	return s.Metrics.Pageins.ComputeRate()
+}
+
+// MinorFaultRate returns page faults per second that
+// did not result in a page-in
+func (s *PerProcessStat) MinorFaultRate() float64 {
+	o := s.Metrics
+	return o.Faults.ComputeRate() - o.Pageins.ComputeRate()
+}
+
 func (s *PerProcessStat) MemUsage() float64 {
 	o := s.Metrics
 	return o.ResidentSize.Get()
 }
 
+// Accessible returns false if CPU times of the process can't be
+// read: task_info(TASK_ABSOLUTETIME_INFO) fails (KERN_FAILURE) for
+// some system processes, e.g. those protected by System Integrity
+// Protection, even when running as root. CPUUsage() of such a
+// process is NaN so ByCPUUsage() leaves it out instead of ranking
+// it as idle; memory statistics are still collected
+func (s *PerProcessStat) Accessible() bool {
+	return !s.inaccessible
+}
+
+// IsAlive returns false once the process is no longer
+// reported by the kernel
+func (s *PerProcessStat) IsAlive() bool {
+	if s.owner == nil {
+		return !s.dead
+	}
+	s.owner.mu.RLock()
+	defer s.owner.mu.RUnlock()
+	return s.alive()
+}
+
+// alive is IsAlive() for callers holding s.owner.mu, darwin
+// entries aren't replaced by Collect()
+func (s *PerProcessStat) alive() bool {
+	return !s.dead
+}
+
+// not implemented on darwin
+func (s *PerProcessStat) IOUsage() float64 {
+	return math.NaN()
+}
+
+// SwapUsage is not available per task on darwin, always 0
+func (s *PerProcessStat) SwapUsage() float64 {
+	return 0
+}
+
+// PeakMemUsage returns the peak resident memory in bytes
+// (resident_size_max)
+func (s *PerProcessStat) PeakMemUsage() float64 {
+	return s.Metrics.ResidentSizeMax.Get()
+}
+
+// MemUsagePct returns resident memory as percentage of
+// physical memory, NaN if that can't be determined
+func (s *PerProcessStat) MemUsagePct() float64 {
+	return (s.MemUsage() / memstat.PhysicalMemory()) * 100
+}
+
+// MemUsageSize returns resident memory as misc.ByteSize
+func (s *PerProcessStat) MemUsageSize() misc.ByteSize {
+	return misc.ByteSize(s.MemUsage())
+}
+
+// VirtualSize returns virtual memory size as misc.ByteSize
+func (s *PerProcessStat) VirtualSize() misc.ByteSize {
+	return misc.ByteSize(s.Metrics.VirtualSize.Get())
+}
+
+// IsKernelThread returns true for system processes (P_SYSTEM),
+// i.e. kernel_task
+func (s *PerProcessStat) IsKernelThread() bool {
+	return s.system
+}
+
 func (s *PerProcessStat) Pid() string {
 	return s.pid
 }
@@ -237,12 +743,70 @@ func (s *PerProcessStat) User() string {
 	return s.user
 }
 
+// Cmdline returns the arguments of the process separated by
+// spaces, "" if they can't be read. Collect() doesn't read them,
+// they are read by the first call and cached, so it is cheap to
+// call for the few processes displayed. Safe to call from any
+// goroutine
+func (s *PerProcessStat) Cmdline() string {
+	return s.cmdline.get(s.pid)
+}
+
+// readCmdline reads KERN_PROCARGS2: argc as an int, the
+// executable path, NUL padding, then argc NUL terminated
+// arguments followed by the environment
+func readCmdline(pid string) string {
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return ""
+	}
+	argmax := C.get_argmax()
+	if argmax <= 4 {
+		return ""
+	}
+	buf := make([]byte, int(argmax))
+	size := C.size_t(argmax)
+	if C.get_process_args(C.pid_t(p), (*C.char)(unsafe.Pointer(&buf[0])), &size) != 0 ||
+		size < 4 {
+		return ""
+	}
+	argc := int(*(*C.int)(unsafe.Pointer(&buf[0])))
+	rest := buf[4:size]
+
+	i := bytes.IndexByte(rest, 0)
+	if i < 0 {
+		return ""
+	}
+	rest = bytes.TrimLeft(rest[i:], "\x00")
+
+	args := make([]string, 0, argc)
+	for len(args) < argc && len(rest) > 0 {
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 {
+			args = append(args, string(rest))
+			break
+		}
+		args = append(args, string(rest[:i]))
+		rest = rest[i+1:]
+	}
+	return strings.Join(args, " ")
+}
+
+// State returns process state as a single character
+// mapped from kinfo_proc p_stat to match the letters used
+// on Linux. Refreshed along with other attributes.
+func (s *PerProcessStat) State() string {
+	return s.state
+}
+
 type PerProcessStatMetrics struct {
 	VirtualSize     *metrics.Gauge
 	ResidentSize    *metrics.Gauge
 	ResidentSizeMax *metrics.Gauge
 	UserTime        *metrics.Counter
 	SystemTime      *metrics.Counter
+	Faults          *metrics.Counter
+	Pageins         *metrics.Counter
 }
 
 func NewPerProcessStatMetrics(m *metrics.MetricContext, pid string) *PerProcessStatMetrics {
@@ -259,6 +823,23 @@ func (s *PerProcessStat) CollectAttributes(pid C.int) {
 	C.get_process_info(&kp, C.pid_t(pid))
 	s.comm = C.GoString((*C.char)(unsafe.Pointer(&kp.kp_proc.p_comm)))
 	s.Uid = int(kp.kp_eproc.e_ucred.cr_uid)
+	s.nice = int(kp.kp_proc.p_nice)
+	s.priority = int(kp.kp_proc.p_priority)
+	s.system = kp.kp_proc.p_flag&C.P_SYSTEM != 0
+	switch kp.kp_proc.p_stat {
+	case C.SIDL:
+		s.state = "I"
+	case C.SRUN:
+		s.state = "R"
+	case C.SSLEEP:
+		s.state = "S"
+	case C.SSTOP:
+		s.state = "T"
+	case C.SZOMB:
+		s.state = "Z"
+	default:
+		s.state = "?"
+	}
 	u, err := user.LookupId(fmt.Sprintf("%v", s.Uid))
 	if err == nil {
 		s.user = u.Username
@@ -0,0 +1,70 @@
+// Copyright (c) 2014 Square, Inc
+
+package pidstat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+// benchmarkCollect times Collect(false) with attribute policy p.
+// Needs root for the privileged processor set port
+func benchmarkCollect(b *testing.B, p AttributePolicy) {
+	c := NewProcessStat(metrics.NewMetricContext("bench"), time.Hour)
+	defer c.Stop()
+	c.SetAttributePolicy(p)
+
+	// first Collect() gathers attributes of every process
+	c.Collect(false)
+	if err := c.LastError(); err != nil {
+		b.Skip(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Collect(false)
+	}
+}
+
+func BenchmarkCollectFixedPolicy(b *testing.B) {
+	benchmarkCollect(b, FixedPolicy{})
+}
+
+func BenchmarkCollectAdaptivePolicy(b *testing.B) {
+	benchmarkCollect(b, RecommendedAdaptivePolicy)
+}
+
+func BenchmarkCollect(b *testing.B) {
+	benchmarkCollect(b, FixedPolicy{})
+}
+
+// BenchmarkProcessorSetPriv compares reusing the cached processor
+// set ports with looking them up again every Collect() as was done
+// before they were cached. Needs root
+func BenchmarkProcessorSetPriv(b *testing.B) {
+	c := NewProcessStat(metrics.NewMetricContext("bench"), time.Hour)
+	defer c.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.processorSetPriv(); err != nil {
+		b.Skip(err)
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := c.processorSetPriv(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("lookup", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c.releasePsetPorts()
+			if err := c.processorSetPriv(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -4,10 +4,12 @@ package pidstat
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/measure/os/misc"
 	"github.com/measure/metrics"
+	"github.com/measure/os/memstat"
+	"github.com/measure/os/misc"
 	"io/ioutil"
 	"math"
 	"os"
@@ -15,7 +17,10 @@ import (
 	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -34,11 +39,30 @@ var _ = fmt.Println
 // m - *metricContext
 // Step - time.Duration
 
+// ProcessStat tracks all processes. Processes is updated by
+// Collect(); use the accessor methods rather than reading
+// it directly from another goroutine
 type ProcessStat struct {
 	Processes map[string]*PerProcessStat
-	m         *metrics.MetricContext
-	x         []*PerProcessStat
-	filter    PidFilterFunc
+	// number of processes tracked, updated by Collect()
+	ProcessCount *metrics.Gauge
+	// number of processes dropped by the last Collect()
+	// to stay within SetMaxProcesses()
+	DroppedProcesses *metrics.Gauge
+	maxProcesses     int
+	mu               sync.RWMutex
+	m                *metrics.MetricContext
+	x                []*PerProcessStat
+	filter           PidFilterFunc
+	onExit           func(*PerProcessStat)
+	onStart          func(*PerProcessStat)
+	cancel           context.CancelFunc
+	// pids to watch, nil tracks every process in /proc
+	watch []int
+	pss   bool  // see SetCollectPss
+	cpus  int32 // onlineCPUs() as of the last Collect(), atomic
+	misc.CollectStatus
+	misc.StepTicker
 }
 
 // Collects metrics every Step seconds
@@ -47,36 +71,119 @@ type ProcessStat struct {
 //   * Collect metrics for newer processes at faster rate
 //   * Slower rate for processes with neglible rate?
 
-func NewProcessStat(m *metrics.MetricContext, Step time.Duration) *ProcessStat {
+func NewProcessStat(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *ProcessStat {
+	return NewProcessStatWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewProcessStatWithContext allocates a new ProcessStat object
+// which stops collecting metrics once ctx is done or Stop()
+// is called
+func NewProcessStatWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *ProcessStat {
+	return newProcessStat(ctx, m, Step, nil, misc.NewOptions(opts...))
+}
+
+// WatchPIDs returns a ProcessStat which only tracks the given
+// pids, looking them up in /proc directly instead of enumerating
+// every process on each Step. Use Process() and IsAlive() to
+// follow the watched pids; exited pids are removed like with
+// NewProcessStat(). SetWatchPIDs() changes the list later
+func WatchPIDs(m *metrics.MetricContext, Step time.Duration, pids []int, opts ...misc.Option) *ProcessStat {
+	return WatchPIDsWithContext(context.Background(), m, Step, pids, opts...)
+}
+
+// WatchPIDsWithContext is WatchPIDs() with collection stopping
+// once ctx is done or Stop() is called
+func WatchPIDsWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, pids []int, opts ...misc.Option) *ProcessStat {
+	watch := make([]int, len(pids))
+	copy(watch, pids)
+	return newProcessStat(ctx, m, Step, watch, misc.NewOptions(opts...))
+}
+
+func newProcessStat(ctx context.Context, m *metrics.MetricContext, Step time.Duration, watch []int, o misc.Options) *ProcessStat {
 	c := new(ProcessStat)
 	c.m = m
+	c.watch = watch
 
 	c.Processes = make(map[string]*PerProcessStat, 64)
+	c.ProcessCount = metrics.NewGauge()
+	m.Register(c.ProcessCount, "pidstat.process_count")
+	c.DroppedProcesses = metrics.NewGauge()
+	m.Register(c.DroppedProcesses, "pidstat.dropped_processes")
 
-	// pool for PerProcessStat objects
-	// stupid trick to avoid depending on GC to free up
-	// temporary pool
-	c.x = make([]*PerProcessStat, 1024)
-	for i, _ := range c.x {
-		c.x[i] = NewPerProcessStat(m, "")
-	}
+	c.resizePool(poolSize(watch))
 
 	// Assign a default filter for pids
 	c.filter = PidFilterFunc(defaultPidFilter)
 
-	ticker := time.NewTicker(Step)
+	ctx, c.cancel = context.WithCancel(ctx)
+	ticker := c.StartTicker(Step, o.Jitter)
 	go func() {
-		for _ = range ticker.C {
-			c.Collect()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Collect()
+			case <-ctx.Done():
+				c.unregister()
+				return
+			}
 		}
 	}()
 
 	return c
 }
 
+// Stop stops periodic collection and unregisters all metrics
+// from the MetricContext. A Collect() in progress is allowed
+// to finish
+func (s *ProcessStat) Stop() {
+	s.cancel()
+}
+
+// SetWatchPIDs changes the pids tracked by a ProcessStat at
+// runtime, looking them up in /proc directly as WatchPIDs() does;
+// nil goes back to scanning all of /proc. Unlike SetPidFilter(),
+// which still reads every process, pids not listed aren't read at
+// all. Tracked processes no longer listed are removed by the next
+// Collect() as if they had exited
+func (s *ProcessStat) SetWatchPIDs(pids []int) {
+	var watch []int
+	if pids != nil {
+		watch = make([]int, len(pids))
+		copy(watch, pids)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watch = watch
+}
+
 func (s *ProcessStat) SetPidFilter(filter PidFilterFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.filter = filter
-	return
+}
+
+// OnExit registers a callback invoked from Collect() for every
+// tracked process that has exited, just before it is removed.
+// The callback runs synchronously so the *PerProcessStat is
+// still valid; it fires at most once per pid
+func (s *ProcessStat) OnExit(f func(*PerProcessStat)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onExit = f
+}
+
+// OnStart registers a callback invoked from Collect() for every
+// process seen for the first time, once its metrics and attributes
+// have been collected. Like OnExit it runs synchronously; for a
+// given pid OnStart always fires before OnExit, and within a single
+// Collect() all OnStart callbacks run before any OnExit callbacks.
+// With SetMaxProcesses it fires again for a dropped process once
+// it is tracked again
+func (s *ProcessStat) OnStart(f func(*PerProcessStat)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onStart = f
 }
 
 // Return list of processes sorted by IO
@@ -89,6 +196,8 @@ func (a ByIOUsage) Less(i, j int) bool { return a[i].IOUsage() > a[j].IOUsage()
 // ByIOUsage() returns an slice of *PerProcessStat entries sorted
 // by Memory usage
 func (c *ProcessStat) ByIOUsage() []*PerProcessStat {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	v := make([]*PerProcessStat, 0)
 	for _, o := range c.Processes {
 		if !math.IsNaN(o.IOUsage()) {
@@ -105,6 +214,8 @@ func (c *ProcessStat) CPUUsagePerCgroup(cgroup string) float64 {
 	if !path.IsAbs(cgroup) {
 		cgroup = "/" + cgroup
 	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
 	for _, o := range c.Processes {
 		if (o.Cgroup("cpu") == cgroup) && !math.IsNaN(o.CPUUsage()) {
@@ -120,6 +231,8 @@ func (c *ProcessStat) MemUsagePerCgroup(cgroup string) float64 {
 	if !path.IsAbs(cgroup) {
 		cgroup = "/" + cgroup
 	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	for _, o := range c.Processes {
 		if (o.Cgroup("memory") == cgroup) && !math.IsNaN(o.MemUsage()) {
 			ret += o.MemUsage()
@@ -132,21 +245,36 @@ func (c *ProcessStat) MemUsagePerCgroup(cgroup string) float64 {
 // Collect is usually called internally based on
 // parameters passed via metric context
 func (c *ProcessStat) Collect() {
-	h := c.Processes
-	for _, v := range h {
-		v.Metrics.dead = true
-	}
+	atomic.StoreInt32(&c.cpus, int32(onlineCPUs()))
+	c.mu.RLock()
+	watch := c.watch
+	c.mu.RUnlock()
 
-	pids, err := ioutil.ReadDir("/proc")
+	pids, err := listPids(watch)
 	if err != nil {
+		c.RecordCollect(err)
 		return
 	}
+	c.resizePool(poolSize(watch))
 
-	// scan 1024 processes at once to pick out the ones
+	h := c.Processes
+	c.mu.Lock()
+	pss := c.pss
+	filter := c.filter
+	onStart := c.onStart
+	c.mu.Unlock()
+	// tracked pids found by this Collect(), the others are
+	// marked dead once the scan is complete
+	seen := make(map[string]bool, len(h))
+
+	// scan up to 1024 processes at once to pick out the ones
 	// that are interesting
+	started := make([]*PerProcessStat, 0)
+	replaced := make([]*PerProcessStat, 0)
+	batch := len(c.x)
 
-	for start_idx := 0; start_idx < len(pids); start_idx += 1024 {
-		end_idx := start_idx + 1024
+	for start_idx := 0; start_idx < len(pids); start_idx += batch {
+		end_idx := start_idx + batch
 		if end_idx > len(pids) {
 			end_idx = len(pids)
 		}
@@ -160,25 +288,204 @@ func (c *ProcessStat) Collect() {
 		c.scanProc(&pids, start_idx, end_idx)
 
 		for i, pidstat := range c.x {
-			if c.filter(pidstat) {
+			// pool entries not filled by scanProc
+			if pidstat.Pid() == "?" {
+				continue
+			}
+			if filter(pidstat) {
+				if pss {
+					pidstat.Metrics.collectPss()
+				}
+				c.mu.Lock()
+				// a different start time means the pid was reused
+				old, ok := h[pidstat.Pid()]
+				if ok && old.Metrics.starttime == pidstat.Metrics.starttime {
+					pidstat.cgroups = old.cgroups
+					pidstat.cmdline = old.cmdline
+				} else {
+					if ok {
+						replaced = append(replaced, old)
+					}
+					pidstat.cgroups = readCgroups(pidstat.Pid())
+					started = append(started, pidstat)
+				}
 				h[pidstat.Pid()] = pidstat
+				seen[pidstat.Pid()] = true
+				pidstat.owner = c
 				pidstat.Metrics.Register() // forces registration with new name
 				c.x[i] = NewPerProcessStat(c.m, "")
 				pidstat.Metrics.dead = false
+				c.mu.Unlock()
+			}
+		}
+	}
+
+	c.mu.Lock()
+	for pid, v := range h {
+		if !seen[pid] {
+			v.Metrics.dead = true
+		}
+	}
+	dropped := c.evict()
+	c.DroppedProcesses.Set(float64(len(dropped)))
+	c.mu.Unlock()
+
+	if onStart != nil {
+		isDropped := make(map[*PerProcessStat]bool, len(dropped))
+		for _, v := range dropped {
+			isDropped[v] = true
+		}
+		for _, v := range started {
+			if !isDropped[v] {
+				onStart(v)
 			}
 		}
 	}
 
-	// remove dead processes
-	for k, v := range h {
+	c.removeDead(replaced)
+	c.RecordCollect(nil)
+}
+
+// removeDead removes processes which weren't found by Collect(),
+// calling the OnExit callback first. replaced are processes whose
+// pid was reused by a new process during Collect(); they are
+// reported to OnExit too but their entries and metric names
+// already belong to the new process. Callbacks run without c.mu
+// held so they can use ProcessStat methods
+func (c *ProcessStat) removeDead(replaced []*PerProcessStat) {
+	c.mu.RLock()
+	exited := make([]*PerProcessStat, 0)
+	for _, v := range c.Processes {
 		if v.Metrics.dead {
-			v.Metrics.Unregister()
-			delete(h, k)
+			exited = append(exited, v)
+		}
+	}
+	onExit := c.onExit
+	c.mu.RUnlock()
+
+	if onExit != nil {
+		for _, v := range replaced {
+			onExit(v)
+		}
+		for _, v := range exited {
+			onExit(v)
 		}
 	}
+
+	c.mu.Lock()
+	for _, v := range exited {
+		v.Metrics.Unregister()
+		delete(c.Processes, v.Pid())
+	}
+	c.ProcessCount.Set(float64(len(c.Processes)))
+	c.mu.Unlock()
 }
 
 // unexported
+
+// unregister removes the metrics of all tracked processes and
+// of ProcessStat itself from the MetricContext
+func (c *ProcessStat) unregister() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.Processes {
+		v.Metrics.Unregister()
+	}
+	c.m.Unregister(c.ProcessCount, "pidstat.process_count")
+	c.m.Unregister(c.DroppedProcesses, "pidstat.dropped_processes")
+}
+
+// SetCollectPss enables reading the proportional set size of
+// tracked processes from /proc/<pid>/smaps_rollup (linux 4.14+),
+// see PssUsage(). It is much cheaper than /proc/<pid>/smaps but
+// still walks the page tables of every process, so it is off by
+// default
+func (c *ProcessStat) SetCollectPss(enable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pss = enable
+}
+
+// evict removes the live processes using the least CPU beyond
+// maxProcesses from c.Processes, unregisters their metrics and
+// returns them. Every process found by Collect() has a fresh CPU
+// usage from the two scans of /proc, so all of them are ranked
+// again on every Collect() and a dropped process is tracked again
+// once it is among the busiest. Must be called with c.mu held
+func (c *ProcessStat) evict() []*PerProcessStat {
+	if c.maxProcesses <= 0 {
+		return nil
+	}
+	v := make([]*PerProcessStat, 0, len(c.Processes))
+	for _, o := range c.Processes {
+		if !o.Metrics.dead {
+			v = append(v, o)
+		}
+	}
+	if len(v) <= c.maxProcesses {
+		return nil
+	}
+	usage := func(o *PerProcessStat) float64 {
+		if u := o.CPUUsage(); !math.IsNaN(u) {
+			return u
+		}
+		return -1
+	}
+	sort.Slice(v, func(i, j int) bool { return usage(v[i]) > usage(v[j]) })
+
+	dropped := v[c.maxProcesses:]
+	for _, o := range dropped {
+		o.Metrics.Unregister()
+		delete(c.Processes, o.Pid())
+	}
+	return dropped
+}
+
+// poolSize returns the number of processes scanned at once
+func poolSize(watch []int) int {
+	n := 1024
+	if watch != nil && len(watch) < n {
+		n = len(watch)
+	}
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// resizePool (re)allocates the pool of PerProcessStat objects
+// scanProc() fills if it doesn't hold n entries. Only called by
+// the collecting goroutine
+func (c *ProcessStat) resizePool(n int) {
+	if len(c.x) == n {
+		return
+	}
+	// pool for PerProcessStat objects
+	// stupid trick to avoid depending on GC to free up
+	// temporary pool
+	c.x = make([]*PerProcessStat, n)
+	for i, _ := range c.x {
+		c.x[i] = NewPerProcessStat(c.m, "")
+	}
+}
+
+// listPids returns the /proc entries to scan, either all of
+// /proc or just the watched pids which still exist
+func listPids(watch []int) ([]os.FileInfo, error) {
+	if watch == nil {
+		return ioutil.ReadDir("/proc")
+	}
+	pids := make([]os.FileInfo, 0, len(watch))
+	for _, pid := range watch {
+		f, err := os.Stat("/proc/" + strconv.Itoa(pid))
+		if err != nil {
+			continue
+		}
+		pids = append(pids, f)
+	}
+	return pids, nil
+}
+
 func (c *ProcessStat) scanProc(pids *[]os.FileInfo, start_idx int, end_idx int) {
 
 	pidre := regexp.MustCompile("^\\d+")
@@ -186,7 +493,7 @@ func (c *ProcessStat) scanProc(pids *[]os.FileInfo, start_idx int, end_idx int)
 		f := (*pids)[i]
 		p := f.Name()
 		if f.IsDir() && pidre.MatchString(p) {
-			pidstat := c.x[i%1024]
+			pidstat := c.x[i%len(c.x)]
 			pidstat.Metrics.Pid = p
 			pidstat.Metrics.Collect()
 		}
@@ -197,17 +504,26 @@ func (c *ProcessStat) scanProc(pids *[]os.FileInfo, start_idx int, end_idx int)
 type PerProcessStat struct {
 	Metrics *PerProcessStatMetrics
 	m       *metrics.MetricContext
+	// /proc/<pid>/cgroup by controller, read once when the
+	// process is first tracked
+	cgroups map[string]string
+	// kept across Collect() like cgroups
+	cmdline *lazyCmdline
+	owner   *ProcessStat // set once tracked, see IsAlive()
 }
 
 func NewPerProcessStat(m *metrics.MetricContext, p string) *PerProcessStat {
 	s := new(PerProcessStat)
 	s.m = m
 	s.Metrics = NewPerProcessStatMetrics(m, p)
+	s.cmdline = new(lazyCmdline)
 	return s
 }
 
 func (s *PerProcessStat) Reset(p string) {
 	s.Metrics.Reset(p)
+	s.cgroups = nil
+	s.cmdline = new(lazyCmdline)
 }
 
 func (s *PerProcessStat) CPUUsage() float64 {
@@ -222,15 +538,158 @@ func (s *PerProcessStat) MemUsage() float64 {
 	return o.Rss.Get() * float64(PAGESIZE)
 }
 
+// MemUsagePct returns resident memory as percentage of
+// physical memory, NaN if that can't be determined
+func (s *PerProcessStat) MemUsagePct() float64 {
+	return (s.MemUsage() / memstat.PhysicalMemory()) * 100
+}
+
+// MemUsageSize returns resident memory as misc.ByteSize
+func (s *PerProcessStat) MemUsageSize() misc.ByteSize {
+	return misc.ByteSize(s.MemUsage())
+}
+
+// VirtualSize returns virtual memory size as misc.ByteSize
+func (s *PerProcessStat) VirtualSize() misc.ByteSize {
+	return misc.ByteSize(s.Metrics.Vsize.Get())
+}
+
+// RSS returns resident memory in bytes as reported by
+// /proc/<pid>/status, i.e. RssAnon + RssFile + RssShmem
+func (s *PerProcessStat) RSS() float64 {
+	return s.Metrics.VmRSS.Get()
+}
+
+// RssAnon returns resident anonymous (private) memory in bytes
+func (s *PerProcessStat) RssAnon() float64 {
+	return s.Metrics.RssAnon.Get()
+}
+
+// RssFile returns resident file mappings in bytes
+func (s *PerProcessStat) RssFile() float64 {
+	return s.Metrics.RssFile.Get()
+}
+
+// RssShmem returns resident shared memory in bytes
+func (s *PerProcessStat) RssShmem() float64 {
+	return s.Metrics.RssShmem.Get()
+}
+
+// PssUsage returns the proportional set size in bytes: resident
+// memory with each shared page divided among the processes mapping
+// it, so unlike MemUsage() it can be summed across processes.
+// Falls back to MemUsage() unless SetCollectPss is enabled and
+// smaps_rollup could be read, which needs linux 4.14+ and the
+// same access as ptrace (root for other users' processes)
+func (s *PerProcessStat) PssUsage() float64 {
+	if pss := s.Metrics.Pss.Get(); !math.IsNaN(pss) {
+		return pss
+	}
+	return s.MemUsage()
+}
+
+// VmSwap returns swapped out anonymous memory in bytes
+func (s *PerProcessStat) VmSwap() float64 {
+	return s.Metrics.VmSwap.Get()
+}
+
+// SwapUsage returns swapped out memory of the process in
+// bytes (VmSwap from /proc/<pid>/status)
+func (s *PerProcessStat) SwapUsage() float64 {
+	return s.Metrics.VmSwap.Get()
+}
+
+// PeakMemUsage returns the peak resident set size in bytes
+// (VmHWM from /proc/<pid>/status)
+func (s *PerProcessStat) PeakMemUsage() float64 {
+	return s.Metrics.VmHWM.Get()
+}
+
+// RunDelayRate returns seconds per second spent by the process
+// waiting on a runqueue, i.e. 0.5 means its threads together were
+// runnable but not running for half of the interval. High values
+// indicate CPU starvation. NaN without CONFIG_SCHEDSTATS
+func (s *PerProcessStat) RunDelayRate() float64 {
+	return s.Metrics.SchedRundelay.ComputeRate() / (1 * 1000 * 1000 * 1000)
+}
+
 func (s *PerProcessStat) IOUsage() float64 {
 	o := s.Metrics
 	return o.IOReadBytes.ComputeRate() + o.IOWriteBytes.ComputeRate()
 }
 
+// Nice returns nice value of the process (-20 to 19)
+func (s *PerProcessStat) Nice() int {
+	return s.Metrics.nice
+}
+
+// Priority returns scheduling priority as reported in
+// /proc/<pid>/stat; for normal processes nice + 20
+func (s *PerProcessStat) Priority() int {
+	return s.Metrics.priority
+}
+
+// MajorFaultRate returns major page faults per second
+// (faults which required loading a page from disk)
+func (s *PerProcessStat) MajorFaultRate() float64 {
+	return s.Metrics.MajFlt.ComputeRate()
+}
+
+// MinorFaultRate returns minor page faults per second
+func (s *PerProcessStat) MinorFaultRate() float64 {
+	return s.Metrics.MinFlt.ComputeRate()
+}
+
+// Accessible always returns true on linux, /proc/<pid>/stat
+// is readable for all processes
+func (s *PerProcessStat) Accessible() bool {
+	return true
+}
+
+// IsAlive returns false once the process is no longer found in
+// /proc. Collect() replaces tracked entries with new objects, so
+// the current entry for the pid is looked up: an object obtained
+// earlier, e.g. from ByCPUUsage() or OnStart, stays alive while
+// the process runs even though its metrics are no longer updated
+func (s *PerProcessStat) IsAlive() bool {
+	if s.owner == nil {
+		return !s.Metrics.dead
+	}
+	s.owner.mu.RLock()
+	defer s.owner.mu.RUnlock()
+	return s.alive()
+}
+
+// alive is IsAlive() for callers holding s.owner.mu
+func (s *PerProcessStat) alive() bool {
+	if s.owner == nil {
+		return !s.Metrics.dead
+	}
+	cur, ok := s.owner.Processes[s.Metrics.Pid]
+	return ok && !cur.Metrics.dead && cur.Metrics.starttime == s.Metrics.starttime
+}
+
+// PF_KTHREAD from include/linux/sched.h
+const pfKthread = 0x00200000
+
+// IsKernelThread returns true for kernel threads. These have no
+// address space (like zombies) and no cmdline, so the kernel's
+// PF_KTHREAD flag is used to tell them apart
+func (s *PerProcessStat) IsKernelThread() bool {
+	return s.Metrics.flags&pfKthread != 0
+}
+
 func (s *PerProcessStat) Pid() string {
 	return s.Metrics.Pid
 }
 
+// State returns the single character process state from
+// /proc/<pid>/stat, e.g. R (running), S (sleeping),
+// D (uninterruptible sleep), Z (zombie)
+func (s *PerProcessStat) State() string {
+	return s.Metrics.state
+}
+
 func (s *PerProcessStat) Comm() string {
 	file, err := os.Open("/proc/" + s.Metrics.Pid + "/stat")
 	defer file.Close()
@@ -241,8 +700,12 @@ func (s *PerProcessStat) Comm() string {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		f := strings.Split(scanner.Text(), " ")
-		return f[1]
+		line := scanner.Text()
+		start, end := strings.IndexByte(line, '('), strings.LastIndexByte(line, ')')
+		if start < 0 || end < start {
+			return ""
+		}
+		return line[start : end+1]
 	}
 
 	return ""
@@ -303,30 +766,76 @@ func (s *PerProcessStat) User() string {
 	return u.Username
 }
 
+// Cmdline returns the arguments of the process separated by
+// spaces, "" for kernel threads, zombies or if it can't be read.
+// Collect() doesn't read it, it is read by the first call and
+// cached while the process is tracked, so it is cheap to call for the
+// few processes displayed. Safe to call from any goroutine
 func (s *PerProcessStat) Cmdline() string {
-	content, err := ioutil.ReadFile("/proc/" + s.Metrics.Pid + "/cmdline")
+	return s.cmdline.get(s.Metrics.Pid)
+}
+
+// readCmdline reads /proc/<pid>/cmdline, arguments are
+// separated by NUL
+func readCmdline(pid string) string {
+	content, err := ioutil.ReadFile("/proc/" + pid + "/cmdline")
 	if err != nil {
-		return string(content)
+		return ""
 	}
-
-	return ""
+	return strings.TrimRight(strings.Replace(string(content), "\x00", " ", -1), " ")
 }
 
+// Cgroup returns the cgroup of the process for controller subsys
+// (e.g. "cpu", "memory"). With cgroup v2, or if subsys isn't
+// mounted as v1, the unified hierarchy path is returned. Returns
+// "/" if unknown. Processes rarely move between cgroups so this
+// is read once when the process is first tracked
 func (s *PerProcessStat) Cgroup(subsys string) string {
-	file, err := os.Open("/proc/" + s.Metrics.Pid + "/cgroup")
+	cgroups := s.cgroups
+	if cgroups == nil {
+		cgroups = readCgroups(s.Metrics.Pid)
+	}
+	if v, ok := cgroups[subsys]; ok {
+		return v
+	}
+	if v, ok := cgroups[""]; ok {
+		return v
+	}
+	return "/"
+}
+
+// CPUCgroup returns the cpu cgroup of the process,
+// e.g. to find its container
+func (s *PerProcessStat) CPUCgroup() string {
+	return s.Cgroup("cpu")
+}
+
+// readCgroups parses /proc/<pid>/cgroup into a map of controller
+// to path. Lines look like "4:cpu,cpuacct:/foo" for cgroup v1 and
+// "0::/foo" for the v2 unified hierarchy, stored under ""
+func readCgroups(pid string) map[string]string {
+	ret := make(map[string]string)
+	file, err := os.Open("/proc/" + pid + "/cgroup")
+	if err != nil {
+		return ret
+	}
 	defer file.Close()
 
-	if err == nil {
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			f := strings.Split(scanner.Text(), ":")
-			if f[1] == subsys {
-				return f[2]
-			}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.SplitN(scanner.Text(), ":", 3)
+		if len(f) != 3 {
+			continue
+		}
+		if f[1] == "" {
+			ret[""] = f[2]
+			continue
+		}
+		for _, subsys := range strings.Split(f[1], ",") {
+			ret[subsys] = f[2]
 		}
 	}
-
-	return "/"
+	return ret
 }
 
 type PerProcessStatMetrics struct {
@@ -334,10 +843,31 @@ type PerProcessStatMetrics struct {
 	Utime        *metrics.Counter
 	Stime        *metrics.Counter
 	Rss          *metrics.Gauge
+	Vsize        *metrics.Gauge
 	IOReadBytes  *metrics.Counter
 	IOWriteBytes *metrics.Counter
-	m            *metrics.MetricContext
-	dead         bool
+	MinFlt       *metrics.Counter
+	MajFlt       *metrics.Counter
+	// from /proc/<pid>/status, in bytes
+	VmRSS    *metrics.Gauge
+	RssAnon  *metrics.Gauge
+	RssFile  *metrics.Gauge
+	RssShmem *metrics.Gauge
+	VmSwap   *metrics.Gauge
+	VmHWM    *metrics.Gauge // peak resident set size
+	// from /proc/<pid>/smaps_rollup in bytes, see SetCollectPss
+	Pss *metrics.Gauge
+	// from /proc/<pid>/schedstat (needs CONFIG_SCHEDSTATS)
+	SchedRuntime    *metrics.Counter // ns spent on cpu
+	SchedRundelay   *metrics.Counter // ns spent waiting on a runqueue
+	SchedTimeslices *metrics.Counter
+	m               *metrics.MetricContext
+	dead            bool
+	state           string
+	flags           uint64 // PF_* flags
+	starttime       uint64 // clock ticks after boot, tells reused pids apart
+	priority        int
+	nice            int
 }
 
 func NewPerProcessStatMetrics(m *metrics.MetricContext, pid string) *PerProcessStatMetrics {
@@ -359,8 +889,21 @@ func (s *PerProcessStatMetrics) Register() {
 	s.m.Register(s.Utime, prefix+"."+"Utime")
 	s.m.Register(s.Stime, prefix+"."+"Stime")
 	s.m.Register(s.Rss, prefix+"."+"Rss")
+	s.m.Register(s.Vsize, prefix+"."+"Vsize")
 	s.m.Register(s.IOReadBytes, prefix+"."+"IOReadBytes")
 	s.m.Register(s.IOWriteBytes, prefix+"."+"IOWriteBytes")
+	s.m.Register(s.MinFlt, prefix+"."+"MinFlt")
+	s.m.Register(s.MajFlt, prefix+"."+"MajFlt")
+	s.m.Register(s.VmRSS, prefix+"."+"VmRSS")
+	s.m.Register(s.RssAnon, prefix+"."+"RssAnon")
+	s.m.Register(s.RssFile, prefix+"."+"RssFile")
+	s.m.Register(s.RssShmem, prefix+"."+"RssShmem")
+	s.m.Register(s.VmSwap, prefix+"."+"VmSwap")
+	s.m.Register(s.VmHWM, prefix+"."+"VmHWM")
+	s.m.Register(s.Pss, prefix+"."+"Pss")
+	s.m.Register(s.SchedRuntime, prefix+"."+"SchedRuntime")
+	s.m.Register(s.SchedRundelay, prefix+"."+"SchedRundelay")
+	s.m.Register(s.SchedTimeslices, prefix+"."+"SchedTimeslices")
 }
 
 // Unregister metrics with metriccontext
@@ -369,17 +912,149 @@ func (s *PerProcessStatMetrics) Unregister() {
 	s.m.Unregister(s.Utime, prefix+"."+"Utime")
 	s.m.Unregister(s.Stime, prefix+"."+"Stime")
 	s.m.Unregister(s.Rss, prefix+"."+"Rss")
+	s.m.Unregister(s.Vsize, prefix+"."+"Vsize")
 	s.m.Unregister(s.IOReadBytes, prefix+"."+"IOReadBytes")
 	s.m.Unregister(s.IOWriteBytes, prefix+"."+"IOWriteBytes")
+	s.m.Unregister(s.MinFlt, prefix+"."+"MinFlt")
+	s.m.Unregister(s.MajFlt, prefix+"."+"MajFlt")
+	s.m.Unregister(s.VmRSS, prefix+"."+"VmRSS")
+	s.m.Unregister(s.RssAnon, prefix+"."+"RssAnon")
+	s.m.Unregister(s.RssFile, prefix+"."+"RssFile")
+	s.m.Unregister(s.RssShmem, prefix+"."+"RssShmem")
+	s.m.Unregister(s.VmSwap, prefix+"."+"VmSwap")
+	s.m.Unregister(s.VmHWM, prefix+"."+"VmHWM")
+	s.m.Unregister(s.Pss, prefix+"."+"Pss")
+	s.m.Unregister(s.SchedRuntime, prefix+"."+"SchedRuntime")
+	s.m.Unregister(s.SchedRundelay, prefix+"."+"SchedRundelay")
+	s.m.Unregister(s.SchedTimeslices, prefix+"."+"SchedTimeslices")
 }
 
 func (s *PerProcessStatMetrics) Reset(pid string) {
 	s.Pid = pid
+	s.state = ""
+	s.starttime = 0
+	s.priority = 0
+	s.nice = 0
 	s.Utime.Reset()
 	s.Stime.Reset()
 	s.Rss.Reset()
+	s.Vsize.Reset()
 	s.IOReadBytes.Reset()
 	s.IOWriteBytes.Reset()
+	s.MinFlt.Reset()
+	s.MajFlt.Reset()
+	s.VmRSS.Reset()
+	s.RssAnon.Reset()
+	s.RssFile.Reset()
+	s.RssShmem.Reset()
+	s.VmSwap.Reset()
+	s.VmHWM.Reset()
+	s.Pss.Reset()
+	s.SchedRuntime.Reset()
+	s.SchedRundelay.Reset()
+	s.SchedTimeslices.Reset()
+}
+
+// collectStatus collects memory breakdown from /proc/<pid>/status
+// Older kernels don't report RssAnon/RssFile/RssShmem, those
+// gauges are left untouched
+func (s *PerProcessStatMetrics) collectStatus() {
+	file, err := os.Open("/proc/" + s.Pid + "/status")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 2 {
+			continue
+		}
+		var g *metrics.Gauge
+		switch f[0] {
+		case "VmRSS:":
+			g = s.VmRSS
+		case "RssAnon:":
+			g = s.RssAnon
+		case "RssFile:":
+			g = s.RssFile
+		case "RssShmem:":
+			g = s.RssShmem
+		case "VmSwap:":
+			g = s.VmSwap
+		case "VmHWM:":
+			g = s.VmHWM
+		default:
+			continue
+		}
+		val := float64(misc.ParseUint(f[1]))
+		if len(f) > 2 && f[2] == "kB" {
+			val *= 1024
+		}
+		g.Set(val)
+	}
+}
+
+// collectPss reads Pss from /proc/<pid>/smaps_rollup, e.g.
+// "Pss:                 385 kB". The gauge is left untouched if
+// the file can't be read
+func (s *PerProcessStatMetrics) collectPss() {
+	file, err := os.Open("/proc/" + s.Pid + "/smaps_rollup")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 2 || f[0] != "Pss:" {
+			continue
+		}
+		val := float64(misc.ParseUint(f[1]))
+		if len(f) > 2 && f[2] == "kB" {
+			val *= 1024
+		}
+		s.Pss.Set(val)
+		return
+	}
+}
+
+// collectSchedstat collects scheduler statistics from
+// /proc/<pid>/schedstat; a no-op if the kernel was built
+// without CONFIG_SCHEDSTATS
+func (s *PerProcessStatMetrics) collectSchedstat() {
+	f, err := misc.ReadFieldsFromFile("/proc/"+s.Pid+"/schedstat", "")
+	if err != nil || len(f) < 3 {
+		return
+	}
+	s.SchedRuntime.Set(misc.ParseUint(f[0]))
+	s.SchedRundelay.Set(misc.ParseUint(f[1]))
+	s.SchedTimeslices.Set(misc.ParseUint(f[2]))
+}
+
+// parseStat parses a line of /proc/<pid>/stat (man 5 proc).
+// comm (field 2) may contain spaces and parentheses, so fields
+// are counted from its last closing parenthesis: f[0] is the
+// state (field 3). Returns false if the line is too short
+func (s *PerProcessStatMetrics) parseStat(line string) bool {
+	f := strings.Fields(line[strings.LastIndexByte(line, ')')+1:])
+	if len(f) < 22 {
+		return false
+	}
+	s.state = f[0]
+	s.flags = misc.ParseUint(f[6])
+	s.starttime = misc.ParseUint(f[19])
+	s.priority, _ = strconv.Atoi(f[15])
+	s.nice, _ = strconv.Atoi(f[16])
+	s.MinFlt.Set(misc.ParseUint(f[7]))
+	s.MajFlt.Set(misc.ParseUint(f[9]))
+	s.Utime.Set(misc.ParseUint(f[11]))
+	s.Stime.Set(misc.ParseUint(f[12]))
+	s.Vsize.Set(float64(misc.ParseUint(f[20])))
+	s.Rss.Set(float64(misc.ParseUint(f[21])))
+	return true
 }
 
 // Collect() collects per process CPU/Memory/IO metrics
@@ -394,12 +1069,12 @@ func (s *PerProcessStatMetrics) Collect() {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		f := strings.Split(scanner.Text(), " ")
-		s.Utime.Set(misc.ParseUint(f[13]))
-		s.Stime.Set(misc.ParseUint(f[14]))
-		s.Rss.Set(float64(misc.ParseUint(f[23])))
+		s.parseStat(scanner.Text())
 	}
 
+	s.collectStatus()
+	s.collectSchedstat()
+
 	// collect IO metrics
 	// only works if we are superuser on Linux
 	file, err = os.Open("/proc/" + s.Pid + "/io")
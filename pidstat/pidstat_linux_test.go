@@ -0,0 +1,122 @@
+// Copyright (c) 2014 Square, Inc
+
+package pidstat
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/measure/metrics"
+)
+
+func TestParseStat(t *testing.T) {
+	const rest = " S 1 1234 1234 0 -1 4194560 1500 0 3 0 120 45 0 0 20 -5 1 0" +
+		" 987654 12345678 2048 18446744073709551615 1 1 0 0 0 0 0 0 0 0 0 0 17 3"
+	tests := []struct {
+		line string
+		ok   bool
+	}{
+		{"1234 (bash)" + rest, true},
+		{"1234 (tmux: server)" + rest, true},
+		{"1234 (Web Content)" + rest, true},
+		// comm may contain parentheses too
+		{"1234 (a) (b) c)" + rest, true},
+		{"1234 (bash) S 1 1234", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		s := NewPerProcessStatMetrics(metrics.NewMetricContext("test"), "1234")
+		if ok := s.parseStat(tt.line); ok != tt.ok {
+			t.Errorf("parseStat(%q) = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		got := []uint64{s.flags, s.MinFlt.Get(), s.MajFlt.Get(), s.Utime.Get(),
+			s.Stime.Get(), s.starttime}
+		want := []uint64{4194560, 1500, 3, 120, 45, 987654}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("parseStat(%q): counters %v, want %v", tt.line, got, want)
+				break
+			}
+		}
+		if s.state != "S" || s.priority != 20 || s.nice != -5 ||
+			s.Vsize.Get() != 12345678 || s.Rss.Get() != 2048 {
+			t.Errorf("parseStat(%q): state %q priority %d nice %d vsize %v rss %v",
+				tt.line, s.state, s.priority, s.nice, s.Vsize.Get(), s.Rss.Get())
+		}
+	}
+}
+
+func TestCPUUsageNormalized(t *testing.T) {
+	m := metrics.NewMetricContext("test")
+	c := &ProcessStat{Processes: make(map[string]*PerProcessStat), m: m, cpus: 4}
+	s := NewPerProcessStat(m, "1")
+	s.owner = c
+	s.Metrics.Utime.Set(0)
+	s.Metrics.Stime.Set(0)
+	time.Sleep(10 * time.Millisecond)
+	s.Metrics.Utime.Set(10)
+	s.Metrics.Stime.Set(5)
+
+	usage := s.CPUUsage()
+	if !(usage > 0) {
+		t.Fatalf("CPUUsage() = %v, want > 0", usage)
+	}
+	// the CPU count cached by the last Collect() is used as is
+	if got, want := s.CPUUsageNormalized(), usage/4; got != want {
+		t.Errorf("CPUUsageNormalized() = %v, want %v", got, want)
+	}
+	// not collected yet, falls back to the current count
+	c.cpus = 0
+	if got, want := s.CPUUsageNormalized(), usage/float64(onlineCPUs()); got != want {
+		t.Errorf("CPUUsageNormalized() before Collect() = %v, want %v", got, want)
+	}
+}
+
+// newBenchProcessStat returns a ProcessStat tracking n processes
+// with two samples of their CPU times each
+func newBenchProcessStat(n int) *ProcessStat {
+	m := metrics.NewMetricContext("bench")
+	c := &ProcessStat{Processes: make(map[string]*PerProcessStat, n), m: m}
+	for i := 0; i < n; i++ {
+		pid := strconv.Itoa(i + 1)
+		s := NewPerProcessStat(m, pid)
+		s.Metrics.Utime.Set(0)
+		s.Metrics.Stime.Set(0)
+		c.Processes[pid] = s
+	}
+	time.Sleep(time.Millisecond)
+	i := uint64(0)
+	for _, s := range c.Processes {
+		i++
+		s.Metrics.Utime.Set(i % 97)
+		s.Metrics.Stime.Set(i % 13)
+	}
+	return c
+}
+
+const benchProcesses = 5000
+
+func BenchmarkTop(b *testing.B) {
+	c := newBenchProcessStat(benchProcesses)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(c.Top(10, CPU)) != 10 {
+			b.Fatal("Top(10) didn't return 10 processes")
+		}
+	}
+}
+
+func BenchmarkByCPUUsageTop(b *testing.B) {
+	c := newBenchProcessStat(benchProcesses)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(c.ByCPUUsage()[:10]) != 10 {
+			b.Fatal("ByCPUUsage()[:10] didn't return 10 processes")
+		}
+	}
+}
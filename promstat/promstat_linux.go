@@ -0,0 +1,123 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package promstat exposes the computed values of cpustat, fsstat
+// and pidstat collectors as a prometheus.Collector. Values are read
+// from the collectors on every scrape. It is the only package
+// depending on github.com/prometheus/client_golang, programs not
+// importing it don't need that dependency
+package promstat
+
+import (
+	"math"
+	"strings"
+
+	"github.com/measure/os/cpustat"
+	"github.com/measure/os/fsstat"
+	"github.com/measure/os/pidstat"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements prometheus.Collector. Any of CPU, FS and
+// Processes may be nil to leave out its metrics. NaN values,
+// e.g. before a collector has two samples, are not exported
+type Collector struct {
+	CPU       *cpustat.CPUStat
+	FS        *fsstat.FSStat
+	Processes *pidstat.ProcessStat
+	// export at most this many processes ordered by CPU usage,
+	// 0 exports all tracked processes
+	MaxProcesses int
+
+	cpuUsage     *prometheus.Desc
+	cpuUserspace *prometheus.Desc
+	cpuKernel    *prometheus.Desc
+	fsUsage      *prometheus.Desc
+	fsFileUsage  *prometheus.Desc
+	fsAvail      *prometheus.Desc
+	procCPU      *prometheus.Desc
+	procMem      *prometheus.Desc
+}
+
+// NewCollector returns a Collector exporting metrics named
+// namespace_cpu_*, namespace_fs_* and namespace_process_*
+func NewCollector(namespace string, cpu *cpustat.CPUStat, fs *fsstat.FSStat, procs *pidstat.ProcessStat) *Collector {
+	c := new(Collector)
+	c.CPU = cpu
+	c.FS = fs
+	c.Processes = procs
+
+	desc := func(subsystem, name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, name),
+			help, labels, nil)
+	}
+	c.cpuUsage = desc("cpu", "usage_percent",
+		"CPU usage in percent", "cpu")
+	c.cpuUserspace = desc("cpu", "userspace_percent",
+		"CPU time spent in userspace in percent", "cpu")
+	c.cpuKernel = desc("cpu", "kernel_percent",
+		"CPU time spent in kernel in percent", "cpu")
+	c.fsUsage = desc("fs", "usage_percent",
+		"Filesystem block usage in percent", "mountpoint", "fstype")
+	c.fsFileUsage = desc("fs", "file_usage_percent",
+		"Filesystem file node usage in percent", "mountpoint", "fstype")
+	c.fsAvail = desc("fs", "avail_bytes",
+		"Filesystem space available to unprivileged users", "mountpoint", "fstype")
+	c.procCPU = desc("process", "cpu_percent",
+		"Process CPU usage in percent", "pid", "comm")
+	c.procMem = desc("process", "resident_bytes",
+		"Process resident memory", "pid", "comm")
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.cpuUsage, c.cpuUserspace,
+		c.cpuKernel, c.fsUsage, c.fsFileUsage, c.fsAvail, c.procCPU,
+		c.procMem} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+		}
+	}
+
+	if c.CPU != nil {
+		snap := c.CPU.Snapshot()
+		gauge(c.cpuUsage, float64(snap.All.UsagePct), "all")
+		gauge(c.cpuUserspace, float64(snap.All.UserspacePct), "all")
+		gauge(c.cpuKernel, float64(snap.All.KernelPct), "all")
+		for cpu, o := range snap.CPUs {
+			gauge(c.cpuUsage, float64(o.UsagePct), cpu)
+			gauge(c.cpuUserspace, float64(o.UserspacePct), cpu)
+			gauge(c.cpuKernel, float64(o.KernelPct), cpu)
+		}
+	}
+
+	if c.FS != nil {
+		for _, o := range c.FS.ByUsage() {
+			gauge(c.fsUsage, o.Usage(), o.Mountpoint(), o.FSType())
+			gauge(c.fsFileUsage, o.FileUsage(), o.Mountpoint(), o.FSType())
+			gauge(c.fsAvail, float64(o.AvailBytes()), o.Mountpoint(), o.FSType())
+		}
+	}
+
+	if c.Processes != nil {
+		var procs []*pidstat.PerProcessStat
+		if c.MaxProcesses > 0 {
+			procs = c.Processes.Top(c.MaxProcesses, pidstat.CPU)
+		} else {
+			procs = c.Processes.ByCPUUsage()
+		}
+		for _, o := range procs {
+			comm := strings.Trim(o.Comm(), "()")
+			gauge(c.procCPU, o.CPUUsage(), o.Pid(), comm)
+			gauge(c.procMem, o.MemUsage(), o.Pid(), comm)
+		}
+	}
+}
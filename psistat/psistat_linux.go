@@ -0,0 +1,165 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package psistat collects Pressure Stall Information
+// (Documentation/accounting/psi.rst) from /proc/pressure
+package psistat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/misc"
+)
+
+// PSIStat holds pressure metrics for cpu, memory and io
+type PSIStat struct {
+	CPU    *PerResourceStat
+	Memory *PerResourceStat
+	IO     *PerResourceStat
+	m      *metrics.MetricContext
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+// PerResourceStat holds the "some" (at least one task stalled)
+// and "full" (all non-idle tasks stalled) lines of a resource.
+// The cpu full line is only reported by linux 5.13 and later
+type PerResourceStat struct {
+	Some *PressureMetrics
+	Full *PressureMetrics
+	path string
+}
+
+// PressureMetrics are registered as psi.<resource>.<some|full>.<name>
+type PressureMetrics struct {
+	Avg10  *metrics.Gauge   `metric:"avg10"`  // % of time stalled, 10s average
+	Avg60  *metrics.Gauge   `metric:"avg60"`  // 60s average
+	Avg300 *metrics.Gauge   `metric:"avg300"` // 300s average
+	Total  *metrics.Counter `metric:"total"`  // total stall time in us
+}
+
+// New returns an instance of PSIStat
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *PSIStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewWithContext returns an instance of PSIStat which stops
+// collecting metrics once ctx is done. If the kernel doesn't
+// support PSI (older than 4.20 or built without CONFIG_PSI)
+// nothing is collected, see Available()
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *PSIStat {
+	s := new(PSIStat)
+	s.m = m
+	s.CPU = newPerResourceStat(m, "cpu")
+	s.Memory = newPerResourceStat(m, "memory")
+	s.IO = newPerResourceStat(m, "io")
+
+	if !Available() {
+		s.RecordCollect(errNotAvailable)
+		return s
+	}
+
+	ticker := s.StartTicker(Step, misc.NewOptions(opts...).Jitter)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Collect()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+var errNotAvailable = errors.New("/proc/pressure not available")
+
+// Available returns true if the kernel provides /proc/pressure
+func Available() bool {
+	_, err := os.Stat("/proc/pressure/cpu")
+	return err == nil
+}
+
+// Collect reads /proc/pressure/{cpu,memory,io}
+func (s *PSIStat) Collect() {
+	var err error
+	for _, r := range []*PerResourceStat{s.CPU, s.Memory, s.IO} {
+		if e := r.collect(); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.RecordCollect(err)
+}
+
+func newPerResourceStat(m *metrics.MetricContext, name string) *PerResourceStat {
+	r := new(PerResourceStat)
+	r.path = "/proc/pressure/" + name
+	r.Some = new(PressureMetrics)
+	r.Full = new(PressureMetrics)
+	misc.InitializeMetrics(r.Some, m, "psi."+name+".some", true)
+	misc.InitializeMetrics(r.Full, m, "psi."+name+".full", true)
+	return r
+}
+
+// collect parses lines like
+// some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func (r *PerResourceStat) collect() error {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 {
+			continue
+		}
+		var p *PressureMetrics
+		switch f[0] {
+		case "some":
+			p = r.Some
+		case "full":
+			p = r.Full
+		default:
+			continue
+		}
+		for _, kv := range f[1:] {
+			i := strings.IndexByte(kv, '=')
+			if i < 0 {
+				continue
+			}
+			k, v := kv[:i], kv[i+1:]
+			switch k {
+			case "avg10":
+				p.Avg10.Set(parseFloat(v))
+			case "avg60":
+				p.Avg60.Set(parseFloat(v))
+			case "avg300":
+				p.Avg300.Set(parseFloat(v))
+			case "total":
+				p.Total.Set(misc.ParseUint(v))
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func parseFloat(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
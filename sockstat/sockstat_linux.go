@@ -0,0 +1,142 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package sockstat collects socket usage per protocol from
+// /proc/net/sockstat and /proc/net/sockstat6, e.g. to diagnose
+// connection or port exhaustion
+package sockstat
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/misc"
+)
+
+// SockStat holds a gauge per protocol and field, registered as
+// sockstat.<protocol>.<field>, e.g. sockstat.TCP.inuse,
+// sockstat.TCP.tw or sockstat.TCP6.inuse. Gauges are created the
+// first time a field is seen; use Get() rather than reading
+// Gauges directly from another goroutine
+type SockStat struct {
+	Gauges map[string]*metrics.Gauge // by "<protocol>.<field>"
+	mu     sync.RWMutex
+	m      *metrics.MetricContext
+	misc.CollectStatus
+	misc.StepTicker
+}
+
+// New returns an instance of SockStat
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *SockStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewWithContext returns an instance of SockStat which stops
+// collecting metrics once ctx is done
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *SockStat {
+	s := new(SockStat)
+	s.m = m
+	s.Gauges = make(map[string]*metrics.Gauge, 32)
+
+	ticker := s.StartTicker(Step, misc.NewOptions(opts...).Jitter)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.Collect()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Collect reads /proc/net/sockstat and /proc/net/sockstat6. The
+// latter is missing if IPv6 is disabled, which isn't an error
+func (s *SockStat) Collect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.collect("/proc/net/sockstat")
+	if err == nil {
+		if e := s.collect("/proc/net/sockstat6"); !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	s.RecordCollect(err)
+}
+
+// collect parses lines like
+// sockets: used 290
+// TCP: inuse 5 orphan 0 tw 2 alloc 8 mem 1
+// TCP6: inuse 3
+func (s *SockStat) collect(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) < 3 {
+			continue
+		}
+		proto := strings.TrimSuffix(f[0], ":")
+		for i := 1; i+1 < len(f); i += 2 {
+			s.gauge(proto + "." + f[i]).Set(float64(misc.ParseUint(f[i+1])))
+		}
+	}
+	return scanner.Err()
+}
+
+// gauge returns the gauge for name, registering it the first
+// time it is seen. Caller holds s.mu
+func (s *SockStat) gauge(name string) *metrics.Gauge {
+	g, ok := s.Gauges[name]
+	if !ok {
+		g = metrics.NewGauge()
+		s.m.Register(g, "sockstat."+name)
+		s.Gauges[name] = g
+	}
+	return g
+}
+
+// Get returns the last value of field for protocol as named by
+// the kernel, e.g. Get("UDP", "inuse"), or NaN if not collected
+func (s *SockStat) Get(protocol, field string) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g, ok := s.Gauges[protocol+"."+field]
+	if !ok {
+		return math.NaN()
+	}
+	return g.Get()
+}
+
+// TimeWaitCount returns the number of TCP sockets in TIME_WAIT.
+// The kernel reports IPv4 and IPv6 together on the TCP line
+func (s *SockStat) TimeWaitCount() float64 {
+	return s.Get("TCP", "tw")
+}
+
+// OrphanCount returns the number of TCP sockets not attached to
+// any file descriptor, limited by net.ipv4.tcp_max_orphans
+func (s *SockStat) OrphanCount() float64 {
+	return s.Get("TCP", "orphan")
+}
+
+// InUse returns the number of sockets in use for protocol, e.g.
+// "TCP" or "TCP6"
+func (s *SockStat) InUse(protocol string) float64 {
+	return s.Get(protocol, "inuse")
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package summary blends the cpustat and loadstat collectors into
+// a single 0-100 "busy" score for dashboards that want one gauge
+package summary
+
+import (
+	"math"
+
+	"github.com/measure/os/cpustat"
+	"github.com/measure/os/loadstat"
+	"github.com/measure/os/misc"
+)
+
+// Weights sets how much each component contributes to the busy
+// score. They are relative and needn't add up to 1; a weight of 0
+// leaves the component out
+type Weights struct {
+	CPU    float64
+	IOWait float64
+	Load   float64
+}
+
+// DefaultWeights favours CPU usage, with load catching run queue
+// saturation and iowait catching storage bound systems
+var DefaultWeights = Weights{CPU: 0.5, IOWait: 0.2, Load: 0.3}
+
+// Score holds the busy score along with the components it was
+// computed from, all 0-100
+type Score struct {
+	Busy   misc.JSONFloat `json:"busy"`
+	CPU    misc.JSONFloat `json:"cpu_pct"`    // cpustat Usage()
+	IOWait misc.JSONFloat `json:"iowait_pct"` // cpustat All.IowaitUsage()
+	// 1 minute load average per online CPU as percentage,
+	// capped at 100 (a load of one task per CPU)
+	Load misc.JSONFloat `json:"load_pct"`
+}
+
+// Busy returns the weighted average of CPU usage, iowait and
+// normalized load using DefaultWeights
+func Busy(c *cpustat.CPUStat, l *loadstat.LoadStat) Score {
+	return BusyWeighted(c, l, DefaultWeights)
+}
+
+// BusyWeighted returns the weighted average of CPU usage, iowait
+// and normalized load. Components without a value yet (NaN, e.g.
+// before the second Collect()) are left out and the remaining
+// weights rescaled; Busy is NaN if none has a value
+func BusyWeighted(c *cpustat.CPUStat, l *loadstat.LoadStat, w Weights) Score {
+	cpu := c.Usage()
+	iowait := c.All.IowaitUsage()
+	load := math.NaN()
+	n := c.OnlineCPUs()
+	if n == 0 {
+		n = c.TotalCPUs()
+	}
+	if n > 0 {
+		load = math.Min(l.Load1.Get()/float64(n)*100, 100)
+	}
+
+	var sum, weights float64
+	for _, v := range []struct{ x, w float64 }{
+		{cpu, w.CPU}, {iowait, w.IOWait}, {load, w.Load},
+	} {
+		if math.IsNaN(v.x) || !(v.w > 0) {
+			continue
+		}
+		sum += v.x * v.w
+		weights += v.w
+	}
+	busy := math.NaN()
+	if weights > 0 {
+		busy = sum / weights
+	}
+
+	return Score{
+		Busy:   misc.JSONFloat(busy),
+		CPU:    misc.JSONFloat(cpu),
+		IOWait: misc.JSONFloat(iowait),
+		Load:   misc.JSONFloat(load),
+	}
+}
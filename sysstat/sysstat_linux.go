@@ -0,0 +1,124 @@
+// Copyright (c) 2014 Square, Inc
+
+// Package sysstat combines the cpustat, fsstat and pidstat
+// collectors into a single system view, e.g. for a /debug/stats
+// HTTP handler. The individual packages remain usable on their own
+package sysstat
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/measure/metrics"
+	"github.com/measure/os/cpustat"
+	"github.com/measure/os/fsstat"
+	"github.com/measure/os/misc"
+	"github.com/measure/os/pidstat"
+)
+
+// SysStat holds one instance of each collector, all sharing the
+// same MetricContext and Step
+type SysStat struct {
+	CPU       *cpustat.CPUStat
+	FS        *fsstat.FSStat
+	Processes *pidstat.ProcessStat
+	Cgroups   *cpustat.CgroupStat
+}
+
+func New(m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *SysStat {
+	return NewWithContext(context.Background(), m, Step, opts...)
+}
+
+// NewWithContext returns an instance of SysStat whose collectors
+// stop collecting metrics once ctx is done. opts are passed to
+// every collector; with misc.WithJitter each draws its own delay
+func NewWithContext(ctx context.Context, m *metrics.MetricContext, Step time.Duration, opts ...misc.Option) *SysStat {
+	s := new(SysStat)
+	s.CPU = cpustat.NewWithContext(ctx, m, Step, opts...)
+	s.FS = fsstat.NewWithContext(ctx, m, Step, opts...)
+	s.Processes = pidstat.NewProcessStatWithContext(ctx, m, Step, opts...)
+	s.Cgroups = cpustat.NewCgroupStatWithContext(ctx, m, Step, opts...)
+	return s
+}
+
+// SetStep changes the collection interval of all collectors.
+// Collect() calls in progress complete first
+func (s *SysStat) SetStep(d time.Duration) {
+	s.CPU.SetStep(d)
+	s.FS.SetStep(d)
+	s.Processes.SetStep(d)
+	s.Cgroups.SetStep(d)
+}
+
+// FSSnapshot holds computed statistics for one filesystem
+type FSSnapshot struct {
+	Mountpoint   string         `json:"mountpoint"`
+	FSType       string         `json:"fstype"`
+	ReadOnly     bool           `json:"read_only"`
+	UsagePct     misc.JSONFloat `json:"usage_pct"`
+	FileUsagePct misc.JSONFloat `json:"file_usage_pct"`
+	TotalBytes   misc.JSONFloat `json:"total_bytes"`
+	AvailBytes   misc.JSONFloat `json:"avail_bytes"`
+}
+
+// ProcessSnapshot holds computed statistics for one process
+type ProcessSnapshot struct {
+	Pid      string         `json:"pid"`
+	State    string         `json:"state"`
+	CPUPct   misc.JSONFloat `json:"cpu_pct"`
+	MemBytes misc.JSONFloat `json:"mem_bytes"`
+}
+
+// Snapshot is a plain copy of the current computed values of
+// all collectors. Processes are ordered by CPU usage and
+// filesystems by block usage; entries without a complete sample
+// yet are left out of Filesystems
+type Snapshot struct {
+	Time        time.Time                `json:"time"`
+	CPU         *cpustat.Snapshot        `json:"cpu"`
+	Filesystems []FSSnapshot             `json:"filesystems"`
+	Processes   []ProcessSnapshot        `json:"processes"`
+	Cgroups     []cpustat.CgroupSnapshot `json:"cgroups"`
+}
+
+// Snapshot returns current computed statistics of all
+// collectors. It is safe to call concurrently with collection
+func (s *SysStat) Snapshot() *Snapshot {
+	r := new(Snapshot)
+	r.Time = misc.Now()
+	r.CPU = s.CPU.Snapshot()
+
+	fs := s.FS.ByUsage()
+	r.Filesystems = make([]FSSnapshot, 0, len(fs))
+	for _, o := range fs {
+		r.Filesystems = append(r.Filesystems, FSSnapshot{
+			Mountpoint:   o.Mountpoint(),
+			FSType:       o.FSType(),
+			ReadOnly:     o.ReadOnly(),
+			UsagePct:     misc.JSONFloat(o.Usage()),
+			FileUsagePct: misc.JSONFloat(o.FileUsage()),
+			TotalBytes:   misc.JSONFloat(o.TotalBytes()),
+			AvailBytes:   misc.JSONFloat(o.AvailBytes()),
+		})
+	}
+
+	procs := s.Processes.ByCPUUsage()
+	r.Processes = make([]ProcessSnapshot, 0, len(procs))
+	for _, o := range procs {
+		r.Processes = append(r.Processes, ProcessSnapshot{
+			Pid:      o.Pid(),
+			State:    o.State(),
+			CPUPct:   misc.JSONFloat(o.CPUUsage()),
+			MemBytes: misc.JSONFloat(o.MemUsage()),
+		})
+	}
+
+	r.Cgroups = s.Cgroups.Snapshot()
+	return r
+}
+
+// MarshalJSON encodes Snapshot() as JSON
+func (s *SysStat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}